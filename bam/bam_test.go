@@ -0,0 +1,354 @@
+package bam
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var test_header = &Header{
+	Text: "@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:chr1\tLN:300000\n@SQ\tSN:chrM\tLN:16569\n",
+	Refs: []Reference{{Name: "chr1", Length: 300000}, {Name: "chrM", Length: 16569}},
+}
+
+// testRecords makes sorted reads spread over both references, some of them
+// spliced or with deletions so they span several bins, and a few unplaced
+// ones at the end
+func testRecords(n int) []*Record {
+	random := rand.New(rand.NewSource(42))
+	var records []*Record
+	for i := 0; i < n; i++ {
+		ref_id := random.Intn(2)
+		length := test_header.Refs[ref_id].Length
+		read_len := 50 + random.Intn(50)
+
+		cigar := []CigarOp{NewCigarOp('M', read_len)}
+		switch random.Intn(10) {
+		case 0:
+			cigar = []CigarOp{NewCigarOp('M', read_len/2), NewCigarOp('N', 20000+random.Intn(30000)), NewCigarOp('M', read_len-read_len/2)}
+		case 1:
+			cigar = []CigarOp{NewCigarOp('S', 5), NewCigarOp('M', read_len/2), NewCigarOp('D', 3), NewCigarOp('M', read_len-read_len/2-5)}
+		case 2:
+			cigar = []CigarOp{NewCigarOp('M', read_len/2), NewCigarOp('I', 2), NewCigarOp('M', read_len-read_len/2-2)}
+		}
+
+		seq := make([]byte, read_len)
+		qual := make([]byte, read_len)
+		for j := range seq {
+			seq[j] = "ACGTN"[random.Intn(5)]
+			qual[j] = byte(random.Intn(41))
+		}
+		rec := &Record{
+			Name:        "read" + strconv.Itoa(i),
+			Ref_id:      ref_id,
+			Pos:         random.Intn(length - 1000),
+			Mapq:        uint8(random.Intn(61)),
+			Flag:        uint16(random.Intn(2) * FlagReverse),
+			Cigar:       cigar,
+			Next_ref_id: -1,
+			Next_pos:    -1,
+			Seq:         seq,
+			Qual:        qual,
+		}
+		rec.SetTagString("CB", "ACGT"+strconv.Itoa(random.Intn(10))+"-1")
+		rec.SetTagInt("NM", random.Intn(5))
+		records = append(records, rec)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Ref_id != records[j].Ref_id {
+			return records[i].Ref_id < records[j].Ref_id
+		}
+		return records[i].Pos < records[j].Pos
+	})
+
+	for i := 0; i < 3; i++ {
+		records = append(records, &Record{
+			Name: "unplaced" + strconv.Itoa(i), Ref_id: -1, Pos: -1, Flag: FlagUnmapped, Cigar: []CigarOp{},
+			Next_ref_id: -1, Next_pos: -1, Seq: []byte("ACGT"), Qual: []byte{30, 30, 30, 30},
+		})
+	}
+	return records
+}
+
+// writeTestBam writes the records to a BAM file in a temporary directory
+func writeTestBam(t *testing.T, records []*Record) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.bam")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	buffered := bufio.NewWriter(file)
+
+	writer, err := NewWriter(buffered, test_header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		if err := writer.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := buffered.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readAll(t *testing.T, path string) (*Header, []*Record) {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	reader, err := NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []*Record
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	return reader.Header, records
+}
+
+func TestWriterReaderRoundTrip(t *testing.T) {
+	records := testRecords(5000)
+	path := writeTestBam(t, records)
+
+	header, read := readAll(t, path)
+	if !reflect.DeepEqual(header, test_header) {
+		t.Errorf("got header %+v, expected %+v", header, test_header)
+	}
+	if len(read) != len(records) {
+		t.Fatalf("read %d records, expected %d", len(read), len(records))
+	}
+	for i := range records {
+		if !reflect.DeepEqual(read[i], records[i]) {
+			t.Fatalf("record %d changed when read back:\n got %+v\nwant %+v", i, read[i], records[i])
+		}
+	}
+
+	cb, found := read[0].TagString("CB")
+	if !found || !strings.HasPrefix(cb, "ACGT") {
+		t.Errorf("got CB tag %q, expected it to be read back", cb)
+	}
+	if err := Quickcheck(path); err != nil {
+		t.Errorf("quickcheck failed on a complete file: %s", err)
+	}
+}
+
+func TestIndexFileQuery(t *testing.T) {
+	records := testRecords(10000)
+	path := writeTestBam(t, records)
+
+	if err := IndexFile(path); err != nil {
+		t.Fatal(err)
+	}
+	index, err := ReadIndexFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the index built while writing should match the one of IndexFile
+	var written bytes.Buffer
+	writer, err := NewWriter(&bytes.Buffer{}, test_header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		if err := writer.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close()
+	writer_index, err := writer.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer_index.Write(&written); err != nil {
+		t.Fatal(err)
+	}
+	on_disk, err := os.ReadFile(path + ".bai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written.Bytes(), on_disk) {
+		t.Error("index built by the writer differs from the one of IndexFile")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	random := rand.New(rand.NewSource(7))
+	regions := [][3]int{{0, 0, 300000}, {1, 0, 16569}, {0, 0, 1}, {1, 16500, 16569}, {0, 299000, 300000}}
+	for i := 0; i < 200; i++ {
+		ref_id := random.Intn(2)
+		beg := random.Intn(test_header.Refs[ref_id].Length)
+		regions = append(regions, [3]int{ref_id, beg, beg + 1 + random.Intn(40000)})
+	}
+
+	for _, region := range regions {
+		ref_id, beg, end := region[0], region[1], region[2]
+		expected := make(map[string]bool)
+		for _, rec := range records {
+			if rec.Ref_id == ref_id && rec.Pos < end && rec.End() > beg {
+				expected[rec.Name] = true
+			}
+		}
+
+		got := make(map[string]bool)
+		err := reader.Query(index, ref_id, beg, end, func(rec *Record) error {
+			if got[rec.Name] {
+				t.Errorf("read %s returned twice for %d:%d-%d", rec.Name, ref_id, beg, end)
+			}
+			got[rec.Name] = true
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("query of %d:%d-%d returned %d reads, expected %d", ref_id, beg, end, len(got), len(expected))
+		}
+	}
+
+	mapped, _ := index.Mapped(1)
+	expected_mapped := 0
+	for _, rec := range records {
+		if rec.Ref_id == 1 {
+			expected_mapped++
+		}
+	}
+	if int(mapped) != expected_mapped {
+		t.Errorf("index counts %d mapped reads on chrM, expected %d", mapped, expected_mapped)
+	}
+}
+
+func TestExtractContig(t *testing.T) {
+	records := testRecords(5000)
+	path := writeTestBam(t, records)
+
+	var expected []*Record
+	for _, rec := range records {
+		if rec.Ref_id == 1 {
+			expected = append(expected, rec)
+		}
+	}
+
+	// without then with the index of the input
+	for _, indexed := range []bool{false, true} {
+		if indexed {
+			if err := IndexFile(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+		output := filepath.Join(t.TempDir(), "chrM.bam")
+		written, err := ExtractContig(path, output, "chrM")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written != len(expected) {
+			t.Errorf("wrote %d reads with index %v, expected %d", written, indexed, len(expected))
+		}
+		_, read := readAll(t, output)
+		if !reflect.DeepEqual(read, expected) {
+			t.Errorf("reads of chrM differ from the input with index %v", indexed)
+		}
+		if err := Quickcheck(output); err != nil {
+			t.Error(err)
+		}
+		if _, err := ReadIndexFile(output); err != nil {
+			t.Errorf("no index written for the extracted reads: %s", err)
+		}
+	}
+
+	if _, err := ExtractContig(path, filepath.Join(t.TempDir(), "x.bam"), "chrX"); err == nil {
+		t.Error("expected an error for a contig that isn't in the header")
+	}
+}
+
+func TestQuickcheckTruncated(t *testing.T) {
+	path := writeTestBam(t, testRecords(2000))
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	truncated := filepath.Join(t.TempDir(), "truncated.bam")
+	if err := os.WriteFile(truncated, content[:len(content)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Quickcheck(truncated); err == nil {
+		t.Error("expected quickcheck to fail on a file cut in half")
+	}
+
+	no_eof := filepath.Join(t.TempDir(), "no_eof.bam")
+	if err := os.WriteFile(no_eof, content[:len(content)-len(bgzf_eof)], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Quickcheck(no_eof); err == nil {
+		t.Error("expected quickcheck to fail on a file missing its EOF block")
+	}
+
+	not_bam := filepath.Join(t.TempDir(), "not.bam")
+	if err := os.WriteFile(not_bam, []byte("@HD\tVN:1.6\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Quickcheck(not_bam); err == nil {
+		t.Error("expected quickcheck to fail on a SAM file")
+	}
+}
+
+func TestIndexUnsorted(t *testing.T) {
+	records := testRecords(100)
+	records[10], records[50] = records[50], records[10]
+	if records[10].Ref_id == records[50].Ref_id && records[10].Pos == records[50].Pos {
+		t.Fatal("swapped reads have the same position")
+	}
+	path := writeTestBam(t, records)
+
+	err := IndexFile(path)
+	if err == nil || !strings.Contains(err.Error(), "not sorted") {
+		t.Errorf("expected an error about unsorted reads, got %v", err)
+	}
+	if _, err := os.Stat(path + ".bai"); !os.IsNotExist(err) {
+		t.Error("an index was written for unsorted reads")
+	}
+
+	// reads on a reference listed before the previous one
+	records = testRecords(100)
+	records[len(records)-4].Ref_id = 0
+	path = writeTestBam(t, records)
+	if err := IndexFile(path); err == nil {
+		t.Error("expected an error for reads going back to an earlier reference")
+	}
+}
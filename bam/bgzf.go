@@ -0,0 +1,270 @@
+package bam
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// BGZF files are a series of gzip members of at most 64kB each, with the size
+// of the member stored in a "BC" extra field so a reader can jump from block to
+// block. A position in the file is a virtual offset: the offset of the block in
+// the file shifted left by 16, or-ed with the offset within the uncompressed block.
+
+const (
+	bgzf_max_data    = 0xff00 // uncompressed bytes per block, as htslib does
+	bgzf_max_block   = 0x10000
+	bgzf_header_size = 18
+	bgzf_footer_size = 8
+)
+
+// bgzf_eof is the empty block ending every BGZF file
+var bgzf_eof = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+var errNotBGZF = errors.New("not a BGZF file")
+
+type bgzfReader struct {
+	r            io.Reader
+	block        []byte // uncompressed data of the current block
+	pos          int    // position of the next byte to read in block
+	coffset      int64  // offset of the current block in the file
+	next_coffset int64
+	cdata        []byte
+	inflater     io.ReadCloser
+}
+
+func newBGZFReader(r io.Reader) *bgzfReader {
+	return &bgzfReader{r: r}
+}
+
+// readBlock loads the block starting at next_coffset
+func (bgzf *bgzfReader) readBlock() error {
+	var header [12]byte
+	_, err := io.ReadFull(bgzf.r, header[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("truncated BGZF block at offset %d", bgzf.next_coffset)
+		}
+		return err
+	}
+	if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 || header[3]&4 == 0 {
+		return errNotBGZF
+	}
+
+	extra := make([]byte, binary.LittleEndian.Uint16(header[10:12]))
+	if _, err := io.ReadFull(bgzf.r, extra); err != nil {
+		return fmt.Errorf("truncated BGZF block at offset %d", bgzf.next_coffset)
+	}
+	block_size := -1
+	for i := 0; i+4 <= len(extra); {
+		field_len := int(binary.LittleEndian.Uint16(extra[i+2 : i+4]))
+		if extra[i] == 'B' && extra[i+1] == 'C' && field_len == 2 && i+6 <= len(extra) {
+			block_size = int(binary.LittleEndian.Uint16(extra[i+4:i+6])) + 1
+		}
+		i += 4 + field_len
+	}
+	if block_size < 0 {
+		return errNotBGZF
+	}
+
+	remaining := block_size - len(header) - len(extra)
+	if remaining < bgzf_footer_size {
+		return fmt.Errorf("invalid BGZF block size at offset %d", bgzf.next_coffset)
+	}
+	if cap(bgzf.cdata) < remaining {
+		bgzf.cdata = make([]byte, remaining)
+	}
+	cdata := bgzf.cdata[:remaining]
+	if _, err := io.ReadFull(bgzf.r, cdata); err != nil {
+		return fmt.Errorf("truncated BGZF block at offset %d", bgzf.next_coffset)
+	}
+
+	footer := cdata[len(cdata)-bgzf_footer_size:]
+	crc := binary.LittleEndian.Uint32(footer[0:4])
+	data_size := int(binary.LittleEndian.Uint32(footer[4:8]))
+	if data_size > bgzf_max_block {
+		return fmt.Errorf("invalid BGZF block data size at offset %d", bgzf.next_coffset)
+	}
+
+	compressed := bytes.NewReader(cdata[:len(cdata)-bgzf_footer_size])
+	if bgzf.inflater == nil {
+		bgzf.inflater = flate.NewReader(compressed)
+	} else if err := bgzf.inflater.(flate.Resetter).Reset(compressed, nil); err != nil {
+		return err
+	}
+	if cap(bgzf.block) < data_size {
+		bgzf.block = make([]byte, data_size)
+	}
+	bgzf.block = bgzf.block[:data_size]
+	if _, err := io.ReadFull(bgzf.inflater, bgzf.block); err != nil {
+		return fmt.Errorf("unable to inflate BGZF block at offset %d: %w", bgzf.next_coffset, err)
+	}
+	if crc32.ChecksumIEEE(bgzf.block) != crc {
+		return fmt.Errorf("checksum mismatch in BGZF block at offset %d", bgzf.next_coffset)
+	}
+
+	bgzf.coffset = bgzf.next_coffset
+	bgzf.next_coffset += int64(block_size)
+	bgzf.pos = 0
+	return nil
+}
+
+func (bgzf *bgzfReader) Read(p []byte) (int, error) {
+	for bgzf.pos >= len(bgzf.block) {
+		if err := bgzf.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, bgzf.block[bgzf.pos:])
+	bgzf.pos += n
+	return n, nil
+}
+
+// Offset is the virtual offset of the next byte to be read
+func (bgzf *bgzfReader) Offset() uint64 {
+	if bgzf.pos >= len(bgzf.block) {
+		return uint64(bgzf.next_coffset) << 16
+	}
+	return uint64(bgzf.coffset)<<16 | uint64(bgzf.pos)
+}
+
+// Seek moves to a virtual offset, the underlying reader has to be an io.Seeker
+func (bgzf *bgzfReader) Seek(voffset uint64) error {
+	seeker, ok := bgzf.r.(io.Seeker)
+	if !ok {
+		return errors.New("BGZF reader can't seek on its input")
+	}
+
+	coffset := int64(voffset >> 16)
+	uoffset := int(voffset & 0xffff)
+	if coffset != bgzf.coffset || len(bgzf.block) == 0 {
+		if _, err := seeker.Seek(coffset, io.SeekStart); err != nil {
+			return err
+		}
+		bgzf.next_coffset = coffset
+		bgzf.block = bgzf.block[:0]
+		if err := bgzf.readBlock(); err != nil {
+			if err == io.EOF && uoffset == 0 {
+				return nil
+			}
+			return err
+		}
+	}
+	if uoffset > len(bgzf.block) {
+		return fmt.Errorf("virtual offset %d is past the end of its block", voffset)
+	}
+	bgzf.pos = uoffset
+	return nil
+}
+
+type bgzfWriter struct {
+	w        io.Writer
+	data     []byte
+	coffset  int64 // compressed bytes written so far
+	deflater *flate.Writer
+	cbuf     bytes.Buffer
+}
+
+func newBGZFWriter(w io.Writer) *bgzfWriter {
+	return &bgzfWriter{w: w, data: make([]byte, 0, bgzf_max_data)}
+}
+
+func (bgzf *bgzfWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(bgzf.data[len(bgzf.data):cap(bgzf.data)], p)
+		bgzf.data = bgzf.data[:len(bgzf.data)+n]
+		p = p[n:]
+		written += n
+		if len(bgzf.data) == cap(bgzf.data) {
+			if err := bgzf.Flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Offset is the virtual offset the next byte written will be at
+func (bgzf *bgzfWriter) Offset() uint64 {
+	return uint64(bgzf.coffset)<<16 | uint64(len(bgzf.data))
+}
+
+// Flush writes what was buffered as a block, so the next write starts a new one
+func (bgzf *bgzfWriter) Flush() error {
+	if len(bgzf.data) == 0 {
+		return nil
+	}
+
+	if err := bgzf.deflate(flate.DefaultCompression); err != nil {
+		return err
+	}
+	if bgzf.cbuf.Len()+bgzf_header_size+bgzf_footer_size > bgzf_max_block {
+		// incompressible data, stored blocks only add a few bytes
+		if err := bgzf.deflate(flate.NoCompression); err != nil {
+			return err
+		}
+	}
+
+	block_size := bgzf.cbuf.Len() + bgzf_header_size + bgzf_footer_size
+	block := make([]byte, 0, block_size)
+	block = append(block, 0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0, 0xff, 6, 0, 'B', 'C', 2, 0)
+	block = appendUint16(block, uint16(block_size-1))
+	block = append(block, bgzf.cbuf.Bytes()...)
+	block = appendUint32(block, crc32.ChecksumIEEE(bgzf.data))
+	block = appendUint32(block, uint32(len(bgzf.data)))
+
+	if _, err := bgzf.w.Write(block); err != nil {
+		return err
+	}
+	bgzf.coffset += int64(len(block))
+	bgzf.data = bgzf.data[:0]
+	return nil
+}
+
+func (bgzf *bgzfWriter) deflate(level int) error {
+	bgzf.cbuf.Reset()
+	var err error
+	if bgzf.deflater == nil || level != flate.DefaultCompression {
+		bgzf.deflater, err = flate.NewWriter(&bgzf.cbuf, level)
+		if err != nil {
+			return err
+		}
+	} else {
+		bgzf.deflater.Reset(&bgzf.cbuf)
+	}
+	if _, err := bgzf.deflater.Write(bgzf.data); err != nil {
+		return err
+	}
+	err = bgzf.deflater.Close()
+	if level != flate.DefaultCompression {
+		bgzf.deflater = nil
+	}
+	return err
+}
+
+// Close flushes the last block and writes the EOF marker, without closing the
+// underlying writer
+func (bgzf *bgzfWriter) Close() error {
+	if err := bgzf.Flush(); err != nil {
+		return err
+	}
+	_, err := bgzf.w.Write(bgzf_eof)
+	bgzf.coffset += int64(len(bgzf_eof))
+	return err
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
@@ -0,0 +1,216 @@
+package bam
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var cram_magic = []byte("CRAM")
+
+// readITF8 reads the variable length integers CRAM uses, the leading ones of
+// the first byte giving the number of bytes following it
+func readITF8(r io.ByteReader) (int, error) {
+	b0, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	extra := 0
+	for extra < 4 && b0&(0x80>>extra) != 0 {
+		extra++
+	}
+	mask := byte(0xff >> (extra + 1))
+	if extra == 4 {
+		// the first byte of a 5 byte ITF8 has no 0 after its leading ones,
+		// leaving its upper 4 bits to the value
+		mask = 0x0f
+	}
+	value := int(b0 & mask)
+	for i := 0; i < extra; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if i == 3 {
+			// the last byte of a 5 byte ITF8 only gives its lower 4 bits
+			value = value<<4 | int(b&0x0f)
+		} else {
+			value = value<<8 | int(b)
+		}
+	}
+	return int(int32(value)), nil
+}
+
+// readLTF8 is the 64 bit version of readITF8
+func readLTF8(r io.ByteReader) (int64, error) {
+	b0, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	extra := 0
+	for extra < 8 && b0&(0x80>>extra) != 0 {
+		extra++
+	}
+	var value int64
+	if extra < 8 {
+		value = int64(b0 & (0xff >> (extra + 1)))
+	}
+	for i := 0; i < extra; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<8 | int64(b)
+	}
+	return value, nil
+}
+
+// readCramHeader reads the SAM header stored in the first container of a CRAM
+// file, which is only ever raw or gzip compressed
+func readCramHeader(r *bufio.Reader) (*Header, error) {
+	definition := make([]byte, 26)
+	if _, err := io.ReadFull(r, definition); err != nil {
+		return nil, fmt.Errorf("unable to read CRAM file definition: %w", err)
+	}
+	if !bytes.Equal(definition[:4], cram_magic) {
+		return nil, fmt.Errorf("not a CRAM file")
+	}
+	major := definition[4]
+
+	// container header, only the number of blocks is needed
+	var container_len int32
+	if err := binary.Read(r, binary.LittleEndian, &container_len); err != nil {
+		return nil, err
+	}
+	for i := 0; i < 4; i++ { // reference, start, span and number of records
+		if _, err := readITF8(r); err != nil {
+			return nil, err
+		}
+	}
+	for i := 0; i < 2; i++ { // record counter and bases
+		if _, err := readLTF8(r); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := readITF8(r); err != nil { // number of blocks
+		return nil, err
+	}
+	n_landmarks, err := readITF8(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n_landmarks; i++ {
+		if _, err := readITF8(r); err != nil {
+			return nil, err
+		}
+	}
+	if major >= 3 {
+		if _, err := r.Discard(4); err != nil { // CRC32
+			return nil, err
+		}
+	}
+
+	// the block holding the header
+	method, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Discard(1); err != nil { // content type
+		return nil, err
+	}
+	if _, err := readITF8(r); err != nil { // content id
+		return nil, err
+	}
+	compressed_size, err := readITF8(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := readITF8(r); err != nil { // raw size
+		return nil, err
+	}
+	if compressed_size < 0 {
+		return nil, fmt.Errorf("invalid CRAM header block size %d", compressed_size)
+	}
+	data := make([]byte, compressed_size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	switch method {
+	case 0:
+	case 1:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = ioutil.ReadAll(gr); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression method %d for the CRAM header", method)
+	}
+
+	if len(data) < 4 {
+		return nil, fmt.Errorf("CRAM header block is too short")
+	}
+	text_len := int(int32(binary.LittleEndian.Uint32(data[:4])))
+	if text_len < 0 || text_len > len(data)-4 {
+		return nil, fmt.Errorf("invalid CRAM header text length %d", text_len)
+	}
+	text := string(bytes.TrimRight(data[4:4+text_len], "\x00"))
+	return &Header{Text: text, Refs: parseSQLines(text)}, nil
+}
+
+// parseSQLines gives the references of the @SQ lines of a SAM header
+func parseSQLines(text string) []Reference {
+	var refs []Reference
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+		if fields[0] != "@SQ" {
+			continue
+		}
+		var ref Reference
+		for _, field := range fields[1:] {
+			switch {
+			case strings.HasPrefix(field, "SN:"):
+				ref.Name = field[3:]
+			case strings.HasPrefix(field, "LN:"):
+				ref.Length, _ = strconv.Atoi(field[3:])
+			}
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// ReadHeaderFile reads the header of a BAM or CRAM file
+func ReadHeaderFile(path string) (*Header, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buffered := bufio.NewReader(file)
+	magic, err := buffered.Peek(4)
+	if err == nil && bytes.Equal(magic, cram_magic) {
+		header, err := readCramHeader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return header, nil
+	}
+
+	reader, err := NewReader(buffered)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return reader.Header, nil
+}
@@ -0,0 +1,38 @@
+package bam
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadITF8(t *testing.T) {
+	tests := []struct {
+		encoded []byte
+		value   int
+	}{
+		{[]byte{0x00}, 0},
+		{[]byte{0x7f}, 127},
+		{[]byte{0x80, 0x80}, 128},
+		{[]byte{0xbf, 0xff}, 0x3fff},
+		{[]byte{0xc1, 0x23, 0x45}, 0x12345},
+		{[]byte{0xe1, 0x23, 0x45, 0x67}, 0x1234567},
+		{[]byte{0xf1, 0x23, 0x45, 0x67, 0x08}, 0x12345678},
+		{[]byte{0xf7, 0xff, 0xff, 0xff, 0x0f}, 0x7fffffff},
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0x0f}, -1},
+		{[]byte{0xf8, 0x00, 0x00, 0x00, 0x00}, -0x80000000},
+	}
+	for _, test := range tests {
+		value, err := readITF8(bytes.NewReader(test.encoded))
+		if err != nil {
+			t.Errorf("reading %x: %s", test.encoded, err)
+			continue
+		}
+		if value != test.value {
+			t.Errorf("read %d from %x, expected %d", value, test.encoded, test.value)
+		}
+	}
+
+	if _, err := readITF8(bytes.NewReader([]byte{0xf0, 0x00})); err == nil {
+		t.Error("no error reading a truncated ITF8")
+	}
+}
@@ -0,0 +1,256 @@
+// Package bam reads and writes BAM files and their BAI index, enough for the
+// pipeline to subset, index and check bam files without samtools.
+package bam
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Quickcheck does what samtools quickcheck does: it makes sure the file has a
+// valid header and wasn't truncated, by looking for the BGZF EOF marker
+func Quickcheck(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := NewReader(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(reader.Header.Refs) == 0 {
+		return fmt.Errorf("%s has no reference in its header", path)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < int64(len(bgzf_eof)) {
+		return fmt.Errorf("%s is truncated", path)
+	}
+	eof := make([]byte, len(bgzf_eof))
+	if _, err := file.ReadAt(eof, info.Size()-int64(len(eof))); err != nil {
+		return err
+	}
+	if !bytes.Equal(eof, bgzf_eof) {
+		return fmt.Errorf("%s is missing its EOF marker, it was likely truncated", path)
+	}
+	return nil
+}
+
+// ReadIndexFile reads the BAI index found next to a BAM file
+func ReadIndexFile(bam_path string) (*Index, error) {
+	file, err := os.Open(bam_path + ".bai")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadIndex(bufio.NewReader(file))
+}
+
+// writeIndexFile writes the index of a BAM file next to it, going through a
+// temporary file so a failed write doesn't leave a broken index behind
+func writeIndexFile(bam_path string, index *Index) error {
+	tmp_path := bam_path + ".bai.tmp"
+	file, err := os.Create(tmp_path)
+	if err != nil {
+		return err
+	}
+	buffered := bufio.NewWriter(file)
+	err = index.Write(buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		os.Remove(tmp_path)
+		return err
+	}
+	return os.Rename(tmp_path, bam_path+".bai")
+}
+
+// IndexFile does what samtools index does, writing the .bai of a coordinate
+// sorted BAM file
+func IndexFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := NewReader(bufio.NewReaderSize(file, 1<<20))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	builder := newIndexBuilder(len(reader.Header.Refs))
+	for {
+		begin := reader.Offset()
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		builder.add(rec, begin, reader.Offset())
+	}
+
+	index, err := builder.finish()
+	if err != nil {
+		return fmt.Errorf("unable to index %s: %w", path, err)
+	}
+	return writeIndexFile(path, index)
+}
+
+// ExtractContig writes the reads of one reference of a coordinate sorted BAM
+// file to a new indexed BAM file with the same header, like samtools view
+// -b input contig would. The index of the input is used when it has one,
+// otherwise the whole file is read. Returns the number of reads written.
+func ExtractContig(input_path string, output_path string, contig string) (int, error) {
+	input, err := os.Open(input_path)
+	if err != nil {
+		return 0, err
+	}
+	defer input.Close()
+
+	index, err := ReadIndexFile(input_path)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("unable to read index of %s: %w", input_path, err)
+	}
+
+	var reader *Reader
+	if index != nil {
+		reader, err = NewReader(input)
+	} else {
+		reader, err = NewReader(bufio.NewReaderSize(input, 1<<20))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", input_path, err)
+	}
+
+	ref_id := reader.Header.RefID(contig)
+	if ref_id < 0 {
+		return 0, fmt.Errorf("contig %s is not in the header of %s", contig, input_path)
+	}
+
+	output, err := os.Create(output_path)
+	if err != nil {
+		return 0, err
+	}
+	defer output.Close()
+	buffered := bufio.NewWriterSize(output, 1<<20)
+
+	writer, err := NewWriter(buffered, reader.Header)
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	write := func(rec *Record) error {
+		written++
+		return writer.Write(rec)
+	}
+
+	if index != nil {
+		err = reader.Query(index, ref_id, 0, reader.Header.Refs[ref_id].Length, write)
+	} else {
+		for {
+			rec, read_err := reader.Read()
+			if read_err == io.EOF {
+				break
+			}
+			if read_err != nil {
+				err = read_err
+				break
+			}
+			if rec.Ref_id == ref_id {
+				if err = write(rec); err != nil {
+					break
+				}
+			}
+		}
+	}
+	if err != nil {
+		return written, fmt.Errorf("%s: %w", input_path, err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return written, err
+	}
+	if err := buffered.Flush(); err != nil {
+		return written, err
+	}
+
+	output_index, err := writer.Index()
+	if err != nil {
+		return written, err
+	}
+	return written, writeIndexFile(output_path, output_index)
+}
+
+// FilterFile writes the reads of a BAM file kept by keep to a new indexed BAM
+// file with the same header. Returns the number of reads written.
+func FilterFile(input_path string, output_path string, keep func(rec *Record) bool) (int, error) {
+	input, err := os.Open(input_path)
+	if err != nil {
+		return 0, err
+	}
+	defer input.Close()
+
+	reader, err := NewReader(bufio.NewReaderSize(input, 1<<20))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", input_path, err)
+	}
+
+	output, err := os.Create(output_path)
+	if err != nil {
+		return 0, err
+	}
+	defer output.Close()
+	buffered := bufio.NewWriterSize(output, 1<<20)
+
+	writer, err := NewWriter(buffered, reader.Header)
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, fmt.Errorf("%s: %w", input_path, err)
+		}
+		if !keep(rec) {
+			continue
+		}
+		if err := writer.Write(rec); err != nil {
+			return written, err
+		}
+		written++
+	}
+
+	if err := writer.Close(); err != nil {
+		return written, err
+	}
+	if err := buffered.Flush(); err != nil {
+		return written, err
+	}
+
+	output_index, err := writer.Index()
+	if err != nil {
+		return written, err
+	}
+	return written, writeIndexFile(output_path, output_index)
+}
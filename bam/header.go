@@ -0,0 +1,99 @@
+package bam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+var bam_magic = []byte("BAM\x01")
+
+// Reference is a sequence reads are aligned to, as listed in the header
+type Reference struct {
+	Name   string
+	Length int
+}
+
+// Header holds the SAM text header and the references of a BAM file
+type Header struct {
+	Text string
+	Refs []Reference
+}
+
+// RefID returns the index of the reference with the given name, or -1
+func (header *Header) RefID(name string) int {
+	for i, ref := range header.Refs {
+		if ref.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func readHeader(r io.Reader) (*Header, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, fmt.Errorf("unable to read BAM magic: %w", err)
+	}
+	if !bytes.Equal(magic, bam_magic) {
+		return nil, fmt.Errorf("not a BAM file")
+	}
+
+	var text_len int32
+	if err := binary.Read(r, binary.LittleEndian, &text_len); err != nil {
+		return nil, err
+	}
+	if text_len < 0 {
+		return nil, fmt.Errorf("invalid BAM header text length %d", text_len)
+	}
+	text := make([]byte, text_len)
+	if _, err := io.ReadFull(r, text); err != nil {
+		return nil, err
+	}
+
+	header := &Header{Text: string(bytes.TrimRight(text, "\x00"))}
+
+	var n_ref int32
+	if err := binary.Read(r, binary.LittleEndian, &n_ref); err != nil {
+		return nil, err
+	}
+	if n_ref < 0 {
+		return nil, fmt.Errorf("invalid number of references %d", n_ref)
+	}
+	for i := int32(0); i < n_ref; i++ {
+		var name_len int32
+		if err := binary.Read(r, binary.LittleEndian, &name_len); err != nil {
+			return nil, err
+		}
+		if name_len < 1 {
+			return nil, fmt.Errorf("invalid length %d for name of reference %d", name_len, i)
+		}
+		name := make([]byte, name_len)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		var ref_len int32
+		if err := binary.Read(r, binary.LittleEndian, &ref_len); err != nil {
+			return nil, err
+		}
+		header.Refs = append(header.Refs, Reference{Name: string(name[:name_len-1]), Length: int(ref_len)})
+	}
+	return header, nil
+}
+
+func (header *Header) write(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.Write(bam_magic)
+	binary.Write(&buf, binary.LittleEndian, int32(len(header.Text)))
+	buf.WriteString(header.Text)
+	binary.Write(&buf, binary.LittleEndian, int32(len(header.Refs)))
+	for _, ref := range header.Refs {
+		binary.Write(&buf, binary.LittleEndian, int32(len(ref.Name)+1))
+		buf.WriteString(ref.Name)
+		buf.WriteByte(0)
+		binary.Write(&buf, binary.LittleEndian, int32(ref.Length))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
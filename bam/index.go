@@ -0,0 +1,300 @@
+package bam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+var bai_magic = []byte("BAI\x01")
+
+// the pseudo-bin holding the offsets and read counts of a reference
+const meta_bin = 37450
+
+const linear_shift = 14 // the linear index has an entry every 16kb
+
+type chunk struct {
+	Begin uint64
+	End   uint64
+}
+
+type refIndex struct {
+	bins      map[uint32][]chunk
+	intervals []uint64
+
+	has_meta bool
+	ref_beg  uint64
+	ref_end  uint64
+	mapped   uint64
+	unmapped uint64
+}
+
+// Index is the BAI index of a BAM file
+type Index struct {
+	refs     []refIndex
+	unplaced uint64 // reads without a reference
+}
+
+// Mapped returns the number of mapped and unmapped reads placed on a reference
+func (index *Index) Mapped(ref_id int) (uint64, uint64) {
+	if ref_id < 0 || ref_id >= len(index.refs) {
+		return 0, 0
+	}
+	return index.refs[ref_id].mapped, index.refs[ref_id].unmapped
+}
+
+// chunks are the parts of the file that may hold reads overlapping [beg, end)
+func (index *Index) chunks(ref_id int, beg int, end int) []chunk {
+	if ref_id < 0 || ref_id >= len(index.refs) || end <= beg {
+		return nil
+	}
+	ref := index.refs[ref_id]
+	if beg < 0 {
+		beg = 0
+	}
+
+	// no read overlapping the region can start before the first read of its 16kb window
+	var min_offset uint64
+	if window := beg >> linear_shift; window < len(ref.intervals) {
+		min_offset = ref.intervals[window]
+	} else if len(ref.intervals) > 0 {
+		min_offset = ref.intervals[len(ref.intervals)-1]
+	}
+
+	var chunks []chunk
+	for _, bin := range reg2bins(beg, end) {
+		for _, c := range ref.bins[uint32(bin)] {
+			if c.End > min_offset {
+				chunks = append(chunks, c)
+			}
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Begin < chunks[j].Begin })
+
+	// merge chunks that overlap so no read is returned twice
+	var merged []chunk
+	for _, c := range chunks {
+		if c.Begin < min_offset {
+			c.Begin = min_offset
+		}
+		if len(merged) > 0 && c.Begin <= merged[len(merged)-1].End {
+			if c.End > merged[len(merged)-1].End {
+				merged[len(merged)-1].End = c.End
+			}
+			continue
+		}
+		merged = append(merged, c)
+	}
+	return merged
+}
+
+// ReadIndex parses a BAI file
+func ReadIndex(r io.Reader) (*Index, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, bai_magic) {
+		return nil, fmt.Errorf("not a BAI file")
+	}
+
+	var n_ref int32
+	if err := binary.Read(r, binary.LittleEndian, &n_ref); err != nil {
+		return nil, err
+	}
+	if n_ref < 0 {
+		return nil, fmt.Errorf("invalid number of references %d in index", n_ref)
+	}
+
+	index := &Index{refs: make([]refIndex, n_ref)}
+	for i := range index.refs {
+		ref := &index.refs[i]
+		ref.bins = make(map[uint32][]chunk)
+
+		var n_bin int32
+		if err := binary.Read(r, binary.LittleEndian, &n_bin); err != nil {
+			return nil, err
+		}
+		for b := int32(0); b < n_bin; b++ {
+			var bin uint32
+			var n_chunk int32
+			if err := binary.Read(r, binary.LittleEndian, &bin); err != nil {
+				return nil, err
+			}
+			if err := binary.Read(r, binary.LittleEndian, &n_chunk); err != nil {
+				return nil, err
+			}
+			if n_chunk < 0 {
+				return nil, fmt.Errorf("invalid number of chunks %d in index", n_chunk)
+			}
+			chunks := make([]chunk, n_chunk)
+			if err := binary.Read(r, binary.LittleEndian, chunks); err != nil {
+				return nil, err
+			}
+
+			if bin == meta_bin && len(chunks) == 2 {
+				ref.has_meta = true
+				ref.ref_beg, ref.ref_end = chunks[0].Begin, chunks[0].End
+				ref.mapped, ref.unmapped = chunks[1].Begin, chunks[1].End
+				continue
+			}
+			ref.bins[bin] = chunks
+		}
+
+		var n_intv int32
+		if err := binary.Read(r, binary.LittleEndian, &n_intv); err != nil {
+			return nil, err
+		}
+		if n_intv < 0 {
+			return nil, fmt.Errorf("invalid number of intervals %d in index", n_intv)
+		}
+		ref.intervals = make([]uint64, n_intv)
+		if err := binary.Read(r, binary.LittleEndian, ref.intervals); err != nil {
+			return nil, err
+		}
+	}
+
+	// the number of unplaced reads is optional
+	err := binary.Read(r, binary.LittleEndian, &index.unplaced)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Write writes the index in the BAI format
+func (index *Index) Write(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.Write(bai_magic)
+	binary.Write(&buf, binary.LittleEndian, int32(len(index.refs)))
+
+	for _, ref := range index.refs {
+		bins := make([]uint32, 0, len(ref.bins))
+		for bin := range ref.bins {
+			bins = append(bins, bin)
+		}
+		sort.Slice(bins, func(i, j int) bool { return bins[i] < bins[j] })
+
+		n_bin := len(bins)
+		if ref.has_meta {
+			n_bin++
+		}
+		binary.Write(&buf, binary.LittleEndian, int32(n_bin))
+		for _, bin := range bins {
+			binary.Write(&buf, binary.LittleEndian, bin)
+			binary.Write(&buf, binary.LittleEndian, int32(len(ref.bins[bin])))
+			binary.Write(&buf, binary.LittleEndian, ref.bins[bin])
+		}
+		if ref.has_meta {
+			binary.Write(&buf, binary.LittleEndian, uint32(meta_bin))
+			binary.Write(&buf, binary.LittleEndian, int32(2))
+			binary.Write(&buf, binary.LittleEndian, []uint64{ref.ref_beg, ref.ref_end, ref.mapped, ref.unmapped})
+		}
+
+		binary.Write(&buf, binary.LittleEndian, int32(len(ref.intervals)))
+		binary.Write(&buf, binary.LittleEndian, ref.intervals)
+	}
+	binary.Write(&buf, binary.LittleEndian, index.unplaced)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// indexBuilder builds the index of records added in coordinate order along
+// with where they start and end in the file
+type indexBuilder struct {
+	index    *Index
+	last_ref int
+	last_pos int
+	err      error
+}
+
+func newIndexBuilder(n_ref int) *indexBuilder {
+	builder := &indexBuilder{
+		index:    &Index{refs: make([]refIndex, n_ref)},
+		last_ref: -1,
+	}
+	for i := range builder.index.refs {
+		builder.index.refs[i].bins = make(map[uint32][]chunk)
+	}
+	return builder
+}
+
+func (builder *indexBuilder) add(rec *Record, begin uint64, end uint64) {
+	if builder.err != nil {
+		return
+	}
+	if rec.Ref_id < 0 {
+		builder.index.unplaced++
+		// unplaced reads come last, anything after them can't be indexed
+		builder.last_ref = len(builder.index.refs)
+		return
+	}
+	if rec.Ref_id >= len(builder.index.refs) {
+		builder.err = fmt.Errorf("read %s is on reference %d which isn't in the header", rec.Name, rec.Ref_id)
+		return
+	}
+	if rec.Ref_id < builder.last_ref || (rec.Ref_id == builder.last_ref && rec.Pos < builder.last_pos) {
+		builder.err = fmt.Errorf("reads are not sorted by coordinate at %s", rec.Name)
+		return
+	}
+	builder.last_ref = rec.Ref_id
+	builder.last_pos = rec.Pos
+
+	ref := &builder.index.refs[rec.Ref_id]
+	rec_end := rec.End()
+	if rec.Pos < 0 {
+		rec_end = 0
+	}
+
+	bin := uint32(4680)
+	if rec.Pos >= 0 {
+		bin = uint32(reg2bin(rec.Pos, rec_end))
+	}
+	chunks := ref.bins[bin]
+	if len(chunks) > 0 && chunks[len(chunks)-1].End == begin {
+		chunks[len(chunks)-1].End = end
+	} else {
+		ref.bins[bin] = append(chunks, chunk{Begin: begin, End: end})
+	}
+
+	if rec.Pos >= 0 {
+		for window := rec.Pos >> linear_shift; window <= (rec_end-1)>>linear_shift; window++ {
+			for len(ref.intervals) <= window {
+				ref.intervals = append(ref.intervals, 0)
+			}
+			if ref.intervals[window] == 0 {
+				ref.intervals[window] = begin
+			}
+		}
+	}
+
+	if !ref.has_meta {
+		ref.has_meta = true
+		ref.ref_beg = begin
+	}
+	ref.ref_end = end
+	if rec.Flag&FlagUnmapped != 0 {
+		ref.unmapped++
+	} else {
+		ref.mapped++
+	}
+}
+
+// finish fills the windows of the linear index that no read starts in
+func (builder *indexBuilder) finish() (*Index, error) {
+	if builder.err != nil {
+		return nil, builder.err
+	}
+	for i := range builder.index.refs {
+		intervals := builder.index.refs[i].intervals
+		for window := 1; window < len(intervals); window++ {
+			if intervals[window] == 0 {
+				intervals[window] = intervals[window-1]
+			}
+		}
+	}
+	return builder.index, nil
+}
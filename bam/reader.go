@@ -0,0 +1,91 @@
+package bam
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Reader reads the records of a BAM file one after the other, or those
+// overlapping a region when given the index of the file
+type Reader struct {
+	bgzf   *bgzfReader
+	Header *Header
+	buf    []byte
+}
+
+// NewReader reads the header of a BAM file. Queries need r to be an io.Seeker.
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{bgzf: newBGZFReader(r)}
+	header, err := readHeader(reader.bgzf)
+	if err != nil {
+		return nil, err
+	}
+	reader.Header = header
+	return reader, nil
+}
+
+// Read returns the next record, or io.EOF once there are none left
+func (reader *Reader) Read() (*Record, error) {
+	var size_buf [4]byte
+	if _, err := io.ReadFull(reader.bgzf, size_buf[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated BAM record")
+		}
+		return nil, err
+	}
+	size := int(int32(binary.LittleEndian.Uint32(size_buf[:])))
+	if size < 32 {
+		return nil, fmt.Errorf("invalid BAM record size %d", size)
+	}
+
+	if cap(reader.buf) < size {
+		reader.buf = make([]byte, size)
+	}
+	data := reader.buf[:size]
+	if _, err := io.ReadFull(reader.bgzf, data); err != nil {
+		return nil, fmt.Errorf("truncated BAM record")
+	}
+
+	rec := &Record{}
+	if err := rec.unmarshal(data); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Offset is the virtual offset of the next record
+func (reader *Reader) Offset() uint64 {
+	return reader.bgzf.Offset()
+}
+
+// Query calls fn with every record overlapping the 0-based [beg, end) region
+// of the reference, in the order they are in the file
+func (reader *Reader) Query(index *Index, ref_id int, beg int, end int, fn func(rec *Record) error) error {
+	for _, c := range index.chunks(ref_id, beg, end) {
+		if err := reader.bgzf.Seek(c.Begin); err != nil {
+			return err
+		}
+		for reader.Offset() < c.End {
+			rec, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			// records are sorted, so none of the next ones can overlap
+			if rec.Ref_id != ref_id || rec.Pos >= end {
+				break
+			}
+			if rec.End() <= beg {
+				continue
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package bam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// flags of a read
+const (
+	FlagPaired        = 0x1
+	FlagProperPair    = 0x2
+	FlagUnmapped      = 0x4
+	FlagMateUnmapped  = 0x8
+	FlagReverse       = 0x10
+	FlagMateReverse   = 0x20
+	FlagRead1         = 0x40
+	FlagRead2         = 0x80
+	FlagSecondary     = 0x100
+	FlagQCFail        = 0x200
+	FlagDuplicate     = 0x400
+	FlagSupplementary = 0x800
+)
+
+const cigar_ops = "MIDNSHP=X"
+const seq_bases = "=ACMGRSVTWYHKDBN"
+
+// CigarOp is an operation of the CIGAR string, packed as in the BAM format
+type CigarOp uint32
+
+func NewCigarOp(op byte, length int) CigarOp {
+	return CigarOp(uint32(length)<<4 | uint32(bytes.IndexByte([]byte(cigar_ops), op)))
+}
+
+// Type is the letter of the operation, like M or D
+func (op CigarOp) Type() byte {
+	if int(op&0xf) >= len(cigar_ops) {
+		return '?'
+	}
+	return cigar_ops[op&0xf]
+}
+
+func (op CigarOp) Len() int {
+	return int(op >> 4)
+}
+
+// ConsumesRef tells whether the operation moves along the reference
+func (op CigarOp) ConsumesRef() bool {
+	switch op.Type() {
+	case 'M', 'D', 'N', '=', 'X':
+		return true
+	}
+	return false
+}
+
+// ConsumesQuery tells whether the operation moves along the read
+func (op CigarOp) ConsumesQuery() bool {
+	switch op.Type() {
+	case 'M', 'I', 'S', '=', 'X':
+		return true
+	}
+	return false
+}
+
+// Record is an aligned read
+type Record struct {
+	Name        string
+	Ref_id      int
+	Pos         int // 0-based leftmost position
+	Mapq        uint8
+	Flag        uint16
+	Cigar       []CigarOp
+	Next_ref_id int
+	Next_pos    int
+	Tlen        int
+	Seq         []byte // bases as letters
+	Qual        []byte // phred scores, without the +33 offset of SAM
+	Aux         []byte // optional fields, in their BAM encoding
+}
+
+// End is the position following the last reference base covered by the read
+func (rec *Record) End() int {
+	end := rec.Pos
+	for _, op := range rec.Cigar {
+		if op.ConsumesRef() {
+			end += op.Len()
+		}
+	}
+	if end == rec.Pos {
+		end++
+	}
+	return end
+}
+
+func (rec *Record) unmarshal(data []byte) error {
+	if len(data) < 32 {
+		return fmt.Errorf("BAM record of %d bytes is too short", len(data))
+	}
+	rec.Ref_id = int(int32(binary.LittleEndian.Uint32(data[0:4])))
+	rec.Pos = int(int32(binary.LittleEndian.Uint32(data[4:8])))
+	name_len := int(data[8])
+	rec.Mapq = data[9]
+	n_cigar := int(binary.LittleEndian.Uint16(data[12:14]))
+	rec.Flag = binary.LittleEndian.Uint16(data[14:16])
+	seq_len := int(int32(binary.LittleEndian.Uint32(data[16:20])))
+	rec.Next_ref_id = int(int32(binary.LittleEndian.Uint32(data[20:24])))
+	rec.Next_pos = int(int32(binary.LittleEndian.Uint32(data[24:28])))
+	rec.Tlen = int(int32(binary.LittleEndian.Uint32(data[28:32])))
+
+	offset := 32
+	if name_len < 1 || seq_len < 0 || offset+name_len+4*n_cigar+(seq_len+1)/2+seq_len > len(data) {
+		return fmt.Errorf("BAM record lengths don't match its size")
+	}
+	rec.Name = string(data[offset : offset+name_len-1])
+	offset += name_len
+
+	rec.Cigar = make([]CigarOp, n_cigar)
+	for i := range rec.Cigar {
+		rec.Cigar[i] = CigarOp(binary.LittleEndian.Uint32(data[offset:]))
+		offset += 4
+	}
+
+	rec.Seq = make([]byte, seq_len)
+	for i := range rec.Seq {
+		packed := data[offset+i/2]
+		if i%2 == 0 {
+			packed >>= 4
+		}
+		rec.Seq[i] = seq_bases[packed&0xf]
+	}
+	offset += (seq_len + 1) / 2
+
+	rec.Qual = append([]byte(nil), data[offset:offset+seq_len]...)
+	offset += seq_len
+
+	rec.Aux = append([]byte(nil), data[offset:]...)
+	return nil
+}
+
+func (rec *Record) marshal() []byte {
+	name_len := len(rec.Name) + 1
+	size := 32 + name_len + 4*len(rec.Cigar) + (len(rec.Seq)+1)/2 + len(rec.Seq) + len(rec.Aux)
+	data := make([]byte, 4, 4+size)
+	binary.LittleEndian.PutUint32(data, uint32(size))
+
+	bin := 4680 // bin of reads without a position
+	if rec.Pos >= 0 {
+		bin = reg2bin(rec.Pos, rec.End())
+	}
+
+	data = appendUint32(data, uint32(int32(rec.Ref_id)))
+	data = appendUint32(data, uint32(int32(rec.Pos)))
+	data = append(data, byte(name_len), rec.Mapq)
+	data = appendUint16(data, uint16(bin))
+	data = appendUint16(data, uint16(len(rec.Cigar)))
+	data = appendUint16(data, rec.Flag)
+	data = appendUint32(data, uint32(len(rec.Seq)))
+	data = appendUint32(data, uint32(int32(rec.Next_ref_id)))
+	data = appendUint32(data, uint32(int32(rec.Next_pos)))
+	data = appendUint32(data, uint32(int32(rec.Tlen)))
+	data = append(data, rec.Name...)
+	data = append(data, 0)
+	for _, op := range rec.Cigar {
+		data = appendUint32(data, uint32(op))
+	}
+
+	packed := make([]byte, (len(rec.Seq)+1)/2)
+	for i, base := range rec.Seq {
+		code := bytes.IndexByte([]byte(seq_bases), base)
+		if code < 0 {
+			code = 15 // N
+		}
+		if i%2 == 0 {
+			packed[i/2] |= byte(code) << 4
+		} else {
+			packed[i/2] |= byte(code)
+		}
+	}
+	data = append(data, packed...)
+
+	if rec.Qual != nil {
+		data = append(data, rec.Qual...)
+	} else {
+		for range rec.Seq {
+			data = append(data, 0xff)
+		}
+	}
+	return append(data, rec.Aux...)
+}
+
+// auxField walks the optional fields of the read, returning the type of the
+// given tag and where its field starts and ends in Aux, the value being at start+3
+func (rec *Record) auxField(tag string) (byte, int, int, bool) {
+	offset := 0
+	for offset+3 <= len(rec.Aux) {
+		name := string(rec.Aux[offset : offset+2])
+		value_type := rec.Aux[offset+2]
+		value := rec.Aux[offset+3:]
+
+		size := 0
+		switch value_type {
+		case 'A', 'c', 'C':
+			size = 1
+		case 's', 'S':
+			size = 2
+		case 'i', 'I', 'f':
+			size = 4
+		case 'Z', 'H':
+			size = bytes.IndexByte(value, 0) + 1
+			if size == 0 {
+				return 0, 0, 0, false
+			}
+		case 'B':
+			if len(value) < 5 {
+				return 0, 0, 0, false
+			}
+			element_size := map[byte]int{'c': 1, 'C': 1, 's': 2, 'S': 2, 'i': 4, 'I': 4, 'f': 4}[value[0]]
+			size = 5 + element_size*int(binary.LittleEndian.Uint32(value[1:5]))
+		default:
+			return 0, 0, 0, false
+		}
+		if size > len(value) {
+			return 0, 0, 0, false
+		}
+
+		if name == tag {
+			return value_type, offset, offset + 3 + size, true
+		}
+		offset += 3 + size
+	}
+	return 0, 0, 0, false
+}
+
+func (rec *Record) aux(tag string) (byte, []byte, bool) {
+	value_type, start, end, found := rec.auxField(tag)
+	if !found {
+		return 0, nil, false
+	}
+	return value_type, rec.Aux[start+3 : end], true
+}
+
+// TagString returns the value of a text tag like CB:Z
+func (rec *Record) TagString(tag string) (string, bool) {
+	value_type, value, found := rec.aux(tag)
+	switch {
+	case !found:
+		return "", false
+	case value_type == 'Z' || value_type == 'H':
+		return string(value[:len(value)-1]), true
+	case value_type == 'A':
+		return string(value), true
+	}
+	return "", false
+}
+
+// TagInt returns the value of an integer tag like NM:i
+func (rec *Record) TagInt(tag string) (int, bool) {
+	value_type, value, found := rec.aux(tag)
+	if !found {
+		return 0, false
+	}
+	switch value_type {
+	case 'c':
+		return int(int8(value[0])), true
+	case 'C':
+		return int(value[0]), true
+	case 's':
+		return int(int16(binary.LittleEndian.Uint16(value))), true
+	case 'S':
+		return int(binary.LittleEndian.Uint16(value)), true
+	case 'i':
+		return int(int32(binary.LittleEndian.Uint32(value))), true
+	case 'I':
+		return int(binary.LittleEndian.Uint32(value)), true
+	case 'f':
+		return int(math.Float32frombits(binary.LittleEndian.Uint32(value))), true
+	}
+	return 0, false
+}
+
+// SetTagString adds a text tag to the read, replacing it if it was already set
+func (rec *Record) SetTagString(tag string, value string) {
+	rec.RemoveTag(tag)
+	rec.Aux = append(rec.Aux, tag[0], tag[1], 'Z')
+	rec.Aux = append(rec.Aux, value...)
+	rec.Aux = append(rec.Aux, 0)
+}
+
+// SetTagInt adds an integer tag to the read, replacing it if it was already set
+func (rec *Record) SetTagInt(tag string, value int) {
+	rec.RemoveTag(tag)
+	rec.Aux = append(rec.Aux, tag[0], tag[1], 'i')
+	rec.Aux = appendUint32(rec.Aux, uint32(int32(value)))
+}
+
+func (rec *Record) RemoveTag(tag string) {
+	_, start, end, found := rec.auxField(tag)
+	if found {
+		rec.Aux = append(rec.Aux[:start], rec.Aux[end:]...)
+	}
+}
+
+// reg2bin is the bin of the BAI index holding a read covering [beg, end)
+func reg2bin(beg int, end int) int {
+	end--
+	switch {
+	case beg>>14 == end>>14:
+		return ((1<<15)-1)/7 + (beg >> 14)
+	case beg>>17 == end>>17:
+		return ((1<<12)-1)/7 + (beg >> 17)
+	case beg>>20 == end>>20:
+		return ((1<<9)-1)/7 + (beg >> 20)
+	case beg>>23 == end>>23:
+		return ((1<<6)-1)/7 + (beg >> 23)
+	case beg>>26 == end>>26:
+		return ((1<<3)-1)/7 + (beg >> 26)
+	}
+	return 0
+}
+
+// reg2bins lists the bins that may hold reads overlapping [beg, end)
+func reg2bins(beg int, end int) []int {
+	end--
+	bins := []int{0}
+	for k := 1 + (beg >> 26); k <= 1+(end>>26); k++ {
+		bins = append(bins, k)
+	}
+	for k := 9 + (beg >> 23); k <= 9+(end>>23); k++ {
+		bins = append(bins, k)
+	}
+	for k := 73 + (beg >> 20); k <= 73+(end>>20); k++ {
+		bins = append(bins, k)
+	}
+	for k := 585 + (beg >> 17); k <= 585+(end>>17); k++ {
+		bins = append(bins, k)
+	}
+	for k := 4681 + (beg >> 14); k <= 4681+(end>>14); k++ {
+		bins = append(bins, k)
+	}
+	return bins
+}
@@ -0,0 +1,48 @@
+package bam
+
+import (
+	"io"
+)
+
+// Writer writes records to a BAM file. When the records are written sorted by
+// coordinate the index of the file is built along the way.
+type Writer struct {
+	bgzf  *bgzfWriter
+	index *indexBuilder
+}
+
+// NewWriter writes the header to w, which is left open by Close
+func NewWriter(w io.Writer, header *Header) (*Writer, error) {
+	writer := &Writer{
+		bgzf:  newBGZFWriter(w),
+		index: newIndexBuilder(len(header.Refs)),
+	}
+	if err := header.write(writer.bgzf); err != nil {
+		return nil, err
+	}
+	// records start in a block of their own, as samtools does
+	if err := writer.bgzf.Flush(); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (writer *Writer) Write(rec *Record) error {
+	begin := writer.bgzf.Offset()
+	if _, err := writer.bgzf.Write(rec.marshal()); err != nil {
+		return err
+	}
+	writer.index.add(rec, begin, writer.bgzf.Offset())
+	return nil
+}
+
+// Close writes the last block and the EOF marker
+func (writer *Writer) Close() error {
+	return writer.bgzf.Close()
+}
+
+// Index returns the index of the records written, or an error if they weren't
+// sorted by coordinate. It should be called after Close.
+func (writer *Writer) Index() (*Index, error) {
+	return writer.index.finish()
+}
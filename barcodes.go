@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"scVarCall/bam"
+
+	"github.com/spf13/viper"
+)
+
+// barcode_pattern parses the cell barcodes, its first group matching the
+// sequence of the barcode and its second, when there is one, the GEM well
+var barcode_pattern *regexp.Regexp
+
+var unsafe_label_chars = regexp.MustCompile(`[^A-Za-z0-9_.]`)
+
+func loadBarcodePattern() error {
+	pattern, err := regexp.Compile(viper.GetString("barcode_pattern"))
+	if err != nil {
+		return err
+	}
+	if pattern.NumSubexp() < 1 {
+		return fmt.Errorf("barcode_pattern %s has no group matching the sequence of the barcode", pattern)
+	}
+	barcode_pattern = pattern
+	return nil
+}
+
+// parseBarcode splits a barcode into its sequence and its GEM well, empty
+// when the barcode has none
+func parseBarcode(name string) (string, string, error) {
+	match := barcode_pattern.FindStringSubmatch(name)
+	if match == nil {
+		return "", "", fmt.Errorf("barcode '%s' doesn't match barcode_pattern %s", name, barcode_pattern)
+	}
+	gem_well := ""
+	if len(match) > 2 {
+		gem_well = match[2]
+	}
+	return match[1], gem_well, nil
+}
+
+// newBarcode gives the cell of a barcode as found in the CB tags
+func newBarcode(name string) (barcode, error) {
+	_, gem_well, err := parseBarcode(name)
+	if err != nil {
+		return barcode{}, err
+	}
+	return barcode{Name: name, Gem_well: gem_well}, nil
+}
+
+// cellLabel is the name of the column of a cell in the variant calls: its
+// sequence, followed by its GEM well unless it is the first one, with anything
+// but letters, digits, dots and underscores replaced so R keeps it as is
+func cellLabel(barcode_name string) string {
+	sequence, gem_well, err := parseBarcode(barcode_name)
+	if err != nil {
+		return "cell_" + unsafe_label_chars.ReplaceAllString(barcode_name, "_")
+	}
+	label := "cell_" + sequence
+	if gem_well != "" && gem_well != "1" {
+		label += "_" + gem_well
+	}
+	return unsafe_label_chars.ReplaceAllString(label, "_")
+}
+
+// barcodeCounts are the reads of a cell barcode found in the deduped bam
+type barcodeCounts struct {
+	reads   int
+	umis    map[string]bool
+	covered []bool // positions of the MT with an aligned base
+	bases   int    // aligned bases on the MT
+}
+
+// countBarcodes goes through a bam once, counting the reads, UMIs and MT
+// coverage of every cell barcode of its reads
+func countBarcodes(bam_path string, contig string) (map[string]*barcodeCounts, int, error) {
+	file, err := os.Open(bam_path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	reader, err := bam.NewReader(bufio.NewReaderSize(file, 1<<20))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", bam_path, err)
+	}
+	ref_id := reader.Header.RefID(contig)
+	if ref_id < 0 {
+		return nil, 0, fmt.Errorf("contig %s is not in the header of %s", contig, bam_path)
+	}
+	contig_length := reader.Header.Refs[ref_id].Length
+
+	barcodes := make(map[string]*barcodeCounts)
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", bam_path, err)
+		}
+		if rec.Flag&(bam.FlagUnmapped|bam.FlagSecondary|bam.FlagSupplementary) != 0 {
+			continue
+		}
+		cell_barcode, found := rec.TagString("CB")
+		if !found {
+			continue
+		}
+
+		counts, found := barcodes[cell_barcode]
+		if !found {
+			counts = &barcodeCounts{umis: make(map[string]bool), covered: make([]bool, contig_length)}
+			barcodes[cell_barcode] = counts
+		}
+		counts.reads++
+		if umi, found := rec.TagString("UB"); found {
+			counts.umis[umi] = true
+		}
+		if rec.Ref_id != ref_id {
+			continue
+		}
+
+		ref_pos := rec.Pos
+		for _, op := range rec.Cigar {
+			switch op.Type() {
+			case 'M', '=', 'X':
+				for pos := ref_pos; pos < ref_pos+op.Len() && pos < contig_length; pos++ {
+					counts.covered[pos] = true
+					counts.bases++
+				}
+			}
+			if op.ConsumesRef() {
+				ref_pos += op.Len()
+			}
+		}
+	}
+	return barcodes, contig_length, nil
+}
+
+// writeBarcodeStats writes a row for every cell barcode, sorted by barcode,
+// the mean depth being over the whole MT
+func writeBarcodeStats(path string, barcodes map[string]*barcodeCounts, contig_length int) error {
+	table, err := newTableWriter(path, "Barcode", "Reads", "UMIs", "Positions_covered", "Mean_depth")
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(barcodes))
+	for name := range barcodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		counts := barcodes[name]
+		positions_covered := 0
+		for _, covered := range counts.covered {
+			if covered {
+				positions_covered++
+			}
+		}
+		table.row(name,
+			strconv.Itoa(counts.reads),
+			strconv.Itoa(len(counts.umis)),
+			strconv.Itoa(positions_covered),
+			strconv.FormatFloat(float64(counts.bases)/float64(contig_length), 'f', 2, 64))
+	}
+	return table.Close()
+}
+
+// barcodeStatsJob lists the cell barcodes of the deduped bam in process
+func barcodeStatsJob(deduped_bam string) job {
+	return job{
+		Name: "barcode_stats",
+		Native: &nativeTask{
+			Description: "count the reads, UMIs and MT coverage of every cell barcode in " + deduped_bam + " into " + barcodeStatsPath(),
+			run: func() error {
+				barcodes, contig_length, err := countBarcodes(deduped_bam, mt_contig.Name)
+				if err != nil {
+					return err
+				}
+				return writeBarcodeStats(barcodeStatsPath(), barcodes, contig_length)
+			},
+		},
+	}
+}
+
+// readBarcodeStats gives the cells listed in the barcode stats of step 7
+func readBarcodeStats(stats_path string) ([]barcode, error) {
+	stats_file, err := os.Open(stats_path)
+	if err != nil {
+		return nil, err
+	}
+	defer stats_file.Close()
+
+	gr, err := gzip.NewReader(stats_file)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	var cells []barcode
+	stats_scanner := bufio.NewScanner(gr)
+	header := true
+	for stats_scanner.Scan() {
+		if header {
+			header = false
+			continue
+		}
+		cell, err := newBarcode(strings.SplitN(stats_scanner.Text(), "\t", 2)[0])
+		if err != nil {
+			return nil, err
+		}
+		cells = append(cells, cell)
+	}
+	return cells, stats_scanner.Err()
+}
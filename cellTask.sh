@@ -0,0 +1,44 @@
+#!/bin/sh
+# Splits, indexes and calls variants on a single cell, as one task of the job
+# array submitted for a chunk of cells. The cell is the one on the line of the
+# chunk manifest matching the task index, with the columns:
+# task index, barcode, barcode file, split bam, variant calling output directory,
+# cell label
+#
+# usage: cellTask.sh manifest.tsv task_index deduped.bam samtools_exec Rscript_exec cores mt_contig mt_length [read filters...]
+# the read filters are given to callVars.R as they are
+
+set -e
+
+manifest="$1"
+task_index="$2"
+deduped_bam="$3"
+samtools_exec="$4"
+Rscript_exec="$5"
+cores="${6:-1}"
+mt_contig="${7:-MT}"
+mt_length="${8:-16569}"
+if [ $# -ge 8 ]; then shift 8; else shift $#; fi
+
+task_line=$(awk -F '\t' -v i="$task_index" '$1 == i' "$manifest")
+if [ -z "$task_line" ]; then
+	echo "No task $task_index in $manifest" >&2
+	exit 1
+fi
+
+barcode=$(printf '%s\n' "$task_line" | cut -f2)
+barcode_file=$(printf '%s\n' "$task_line" | cut -f3)
+bam_out=$(printf '%s\n' "$task_line" | cut -f4)
+varcall_dir=$(printf '%s\n' "$task_line" | cut -f5)
+cell_label=$(printf '%s\n' "$task_line" | cut -f6)
+
+echo "Task $task_index of $manifest: $barcode"
+
+subset-bam --cores "$cores" \
+	--bam "$deduped_bam" \
+	--cell-barcodes "$barcode_file" \
+	--out-bam "$bam_out"
+
+"$samtools_exec" index "$bam_out"
+
+"$Rscript_exec" callVars.R "$bam_out" "$varcall_dir" "$mt_contig" "$mt_length" "$cell_label" "$@"
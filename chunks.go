@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/spf13/viper"
+)
+
+// setCellPaths defines where the split bam and variant calls of a cell are written to
+func setCellPaths(cell *barcode, chunk_output string) {
+	cell.Splitbam_bamout = chunk_output + "cell_" + cell.Name + ".bam"
+	cell.Splitbam_bamindex = cell.Splitbam_bamout + ".bai"
+	cell.Splitbam_barcodefile = chunk_output + "barcode_" + cell.Name + ".txt"
+	cell.Rvarcall_dir_out = chunk_output
+
+	// set expected output merged rds filenames to barcode object
+	cell.Rvarcall_call_out = cell.Rvarcall_dir_out + cellLabel(cell.Name) + ".calls.rds"
+	cell.Rvarcall_cov_out = cell.Rvarcall_dir_out + cellLabel(cell.Name) + ".coverage.rds"
+}
+
+// writeBarcodeFile writes a file with the barcode of the cell inside for splitbam
+func writeBarcodeFile(cell *barcode) error {
+	return os.WriteFile(cell.Splitbam_barcodefile, []byte(cell.Name+"\n"), 0644)
+}
+
+// cellSplitJob subsets the deduped bam to the reads of a cell
+func cellSplitJob(cell *barcode, chunk_output string, deduped_bam string) job {
+	cell.Splitbam_jobout = chunk_output + "cellsplit_" + cell.Name + ".o"
+	cell.Splitbam_joberr = chunk_output + "cellsplit_" + cell.Name + ".e"
+
+	return withResources("cell_split", job{
+		Name:   "cellsplit_" + cell.Name,
+		Stdout: cell.Splitbam_jobout,
+		Stderr: cell.Splitbam_joberr,
+		Command: []string{
+			"subset-bam", "--cores", strconv.Itoa(stepCores("cell_split")),
+			"--bam", deduped_bam,
+			"--cell-barcodes", cell.Splitbam_barcodefile,
+			"--out-bam", cell.Splitbam_bamout},
+	})
+}
+
+func cellIndexJob(cell *barcode, chunk_output string) job {
+	cell.Splitbam_index_jobout = chunk_output + "cellindex_" + cell.Name + ".o"
+	cell.Splitbam_index_joberr = chunk_output + "cellindex_" + cell.Name + ".e"
+
+	return withResources("cell_index", job{
+		Name:    "cellindex_" + cell.Name,
+		Stdout:  cell.Splitbam_index_jobout,
+		Stderr:  cell.Splitbam_index_joberr,
+		Command: []string{samtools_exec, "index", cell.Splitbam_bamout},
+	})
+}
+
+func cellVarcallJob(cell *barcode, chunk_output string) job {
+	cell.Rvarcall_jobout = chunk_output + "Rvarcall_" + cell.Name + ".o"
+	cell.Rvarcall_joberr = chunk_output + "Rvarcall_" + cell.Name + ".e"
+
+	return withResources("cell_varcall", job{
+		Name:   "Rvarcall_" + cell.Name,
+		Stdout: cell.Rvarcall_jobout,
+		Stderr: cell.Rvarcall_joberr,
+		Command: append([]string{
+			Rscript_exec, "callVars.R",
+			cell.Splitbam_bamout,
+			cell.Rvarcall_dir_out,
+			mt_contig.Name, strconv.Itoa(mt_contig.Length),
+			cellLabel(cell.Name)},
+			read_filters.callVarsArgs()...),
+	})
+}
+
+// setCellTaskPaths sets where the task of a cell finds its line in the chunk
+// manifest and writes its logs when the chunk is run as a job array
+func setCellTaskPaths(cell *barcode, chunk_output string, manifest_path string, task_index int) {
+	cell.Celltask_manifest = manifest_path
+	cell.Celltask_index = task_index
+	cell.Celltask_jobout = chunk_output + "celltask_" + strconv.Itoa(task_index) + ".o"
+	cell.Celltask_joberr = chunk_output + "celltask_" + strconv.Itoa(task_index) + ".e"
+}
+
+// cellTaskArrayJob runs every stage of a cell in one go, taking the cell from
+// the line of the manifest given by the task index
+func cellTaskArrayJob(chunk_output string, chunk_i int, manifest_path string, deduped_bam string) job {
+	return withResources("cell_task", job{
+		Name:   "celltask_" + strconv.Itoa(chunk_i) + "_" + array_index_placeholder,
+		Stdout: chunk_output + "celltask_" + array_index_placeholder + ".o",
+		Stderr: chunk_output + "celltask_" + array_index_placeholder + ".e",
+		Command: append([]string{
+			"sh", "cellTask.sh",
+			manifest_path, array_index_placeholder,
+			deduped_bam,
+			samtools_exec, Rscript_exec,
+			strconv.Itoa(stepCores("cell_task")),
+			mt_contig.Name, strconv.Itoa(mt_contig.Length)},
+			read_filters.callVarsArgs()...),
+	})
+}
+
+// cellFinished tells whether the work on a cell is over, either because its
+// variants were called or because one of its jobs failed. Cells whose jobs were
+// cancelled when the pipeline was interrupted are not, and are run again on resume.
+func cellFinished(cell *barcode) bool {
+	if cell.Rvarcall_command_successful {
+		return true
+	}
+	for _, record := range cell.Jobs {
+		if record.State != jobDone && record.State != jobCancelled {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingCells returns the cells of a chunk that still have to be run, forgetting
+// how far they got before an interruption as they are started over
+func pendingCells(chunk []barcode) []*barcode {
+	var pending []*barcode
+	for i := range chunk {
+		cell := &chunk[i]
+		if cellFinished(cell) {
+			continue
+		}
+		cell.Splitbam_successful = false
+		cell.Splitbam_indexed = false
+		pending = append(pending, cell)
+	}
+	return pending
+}
+
+// submitChunkJobs splits, indexes and calls variants on every pending cell of a
+// chunk, submitting a separate job for each cell at each of these stages
+func submitChunkJobs(chunk []barcode, chunk_output string) error {
+	chunk_cell_map := make(map[string]job)
+
+	for _, cell := range pendingCells(chunk) {
+		setCellPaths(cell, chunk_output)
+
+		err := writeBarcodeFile(cell)
+		if err != nil {
+			return err
+		}
+
+		// split bam to current barcode, adding it to list of current jobs
+		chunk_cell_map[cell.Name] = cellSplitJob(cell, chunk_output, (&barcode_list[0]).Masterbam_UMI_deduped)
+	}
+
+	// wait for that chunks splits to finish
+	err := jobsAreCompleted(chunk_cell_map, "Splitbam", "Splitbam_successful", &chunk, []string{"Splitbam_jobout", "Splitbam_joberr", "Splitbam_barcodefile"})
+	if err != nil {
+		return err
+	}
+
+	// index the split bam files
+	for i := range chunk {
+		cell := &chunk[i]
+		if cell.Splitbam_successful && !cell.Rvarcall_command_successful {
+
+			chunk_cell_map[cell.Name] = cellIndexJob(cell, chunk_output)
+		}
+	}
+
+	// wait for the indexing to finish
+	err = jobsAreCompleted(chunk_cell_map, "Splitbam_index", "Splitbam_indexed", &chunk, []string{"Splitbam_index_jobout", "Splitbam_index_joberr"})
+	if err != nil {
+		return err
+	}
+
+	// run variant calling on the bam files
+	for i := range chunk {
+		cell := &chunk[i]
+		if cell.Splitbam_indexed && !cell.Rvarcall_command_successful {
+
+			// call variants on bam, adding it to list of current jobs
+			chunk_cell_map[cell.Name] = cellVarcallJob(cell, chunk_output)
+		}
+	}
+
+	// wait for variant calls to finish
+	return jobsAreCompleted(chunk_cell_map, "Rvarcall", "Rvarcall_command_successful", &chunk, []string{"Rvarcall_jobout", "Rvarcall_joberr", "Splitbam_bamout", "Splitbam_bamindex"})
+}
+
+// submitChunkArray does the same work as submitChunkJobs, but as a single job
+// array for the pending cells of the chunk. Each task runs cellTask.sh on the
+// cell found on its line of the chunk manifest, and its status is still
+// recorded on the cell.
+func submitChunkArray(chunk []barcode, chunk_output string, chunk_i int, array_exec arrayExecutor) error {
+	pending := pendingCells(chunk)
+	if len(pending) == 0 {
+		return nil
+	}
+
+	manifest_path := chunk_output + "manifest.tsv"
+	manifest, err := os.Create(manifest_path)
+	if err != nil {
+		return err
+	}
+
+	cells := make(map[string]*barcode)
+	for i, cell := range pending {
+		setCellPaths(cell, chunk_output)
+		setCellTaskPaths(cell, chunk_output, manifest_path, i+1)
+
+		err := writeBarcodeFile(cell)
+		if err != nil {
+			manifest.Close()
+			return err
+		}
+		_, err = fmt.Fprintf(manifest, "%d\t%s\t%s\t%s\t%s\t%s\n",
+			cell.Celltask_index, cell.Name, cell.Splitbam_barcodefile, cell.Splitbam_bamout, cell.Rvarcall_dir_out, cellLabel(cell.Name))
+		if err != nil {
+			manifest.Close()
+			return err
+		}
+
+		cells[cell.Name] = cell
+	}
+	err = manifest.Close()
+	if err != nil {
+		return err
+	}
+
+	array_job := cellTaskArrayJob(chunk_output, chunk_i, manifest_path, (&barcode_list[0]).Masterbam_UMI_deduped)
+
+	tracker := newRetryingJobTracker()
+	array_id, err := array_exec.SubmitArray(array_job, len(pending))
+	if err != nil {
+		// fall back to submitting the tasks one by one
+		log.Println(fmt.Sprintf("Unable to submit job array for chunk %d: %s", chunk_i, err))
+		for _, cell := range pending {
+			tracker.enqueue(cell.Name, arrayTask(array_job, strconv.Itoa(cell.Celltask_index)))
+		}
+	} else {
+		log.Println(fmt.Sprintf("Submitted job array %s for the %d cells of chunk %d", array_id, len(pending), chunk_i))
+		for _, cell := range pending {
+			task_index := cell.Celltask_index
+			tracker.track(cell.Name, array_exec.TaskID(array_id, task_index), arrayTask(array_job, strconv.Itoa(task_index)))
+		}
+	}
+
+	return tracker.waitAll(func(name string, record jobRecord) {
+		cell := cells[name]
+		cell.recordJob("Celltask", record)
+
+		// a task runs every stage of the cell, so look at what it produced to know how far it went
+		cell.Splitbam_successful = fileExists(cell.Splitbam_bamout)
+		cell.Splitbam_indexed = fileExists(cell.Splitbam_bamindex)
+
+		if record.State != jobDone {
+			if record.State != jobCancelled {
+				log.Println(fmt.Sprintf("Error with job %s for %s: %s, exit code %d", record.Job_id, name, record.State, record.Exit_code))
+			}
+			return
+		}
+		cell.Rvarcall_command_successful = true
+
+		for _, file := range []string{cell.Celltask_jobout, cell.Celltask_joberr, cell.Splitbam_barcodefile, cell.Splitbam_bamout, cell.Splitbam_bamindex} {
+			err := os.Remove(file)
+			if err != nil && !os.IsNotExist(err) {
+				log.Println(fmt.Sprintf("Unable to remove intermediate file: %s", err))
+			}
+		}
+	})
+}
+
+// chunkMerged tells whether the calls of every finished cell of a chunk made
+// it into the merged rds of the chunk
+func chunkMerged(chunk []barcode) bool {
+	for i := range chunk {
+		cell := &chunk[i]
+		if !cellFinished(cell) || (cell.Rvarcall_command_successful && !cell.Rdsmerge_success) {
+			return false
+		}
+	}
+	return true
+}
+
+// useJobArrays tells whether the cells of a chunk should be submitted as a job array
+func useJobArrays() (arrayExecutor, bool) {
+	array_exec, supported := job_executor.(arrayExecutor)
+	return array_exec, supported && viper.GetBool("job_arrays")
+}
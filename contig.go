@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"scVarCall/bam"
+
+	"github.com/spf13/viper"
+)
+
+// mt_contig is the mitochondrial contig of the input, found in its header
+// when the pipeline starts
+var mt_contig bam.Reference
+
+// findMTContig looks for the first of the mt_contig_aliases among the @SQ
+// lines of the header of the input
+func findMTContig(input string) (bam.Reference, error) {
+	header, err := bam.ReadHeaderFile(input)
+	if err != nil {
+		return bam.Reference{}, fmt.Errorf("unable to read the header of %s: %w", input, err)
+	}
+
+	aliases := viper.GetStringSlice("mt_contig_aliases")
+	for _, alias := range aliases {
+		for _, ref := range header.Refs {
+			if ref.Name == alias {
+				if ref.Length <= 0 {
+					return bam.Reference{}, fmt.Errorf("mitochondrial contig %s of %s has no length in its header", ref.Name, input)
+				}
+				return ref, nil
+			}
+		}
+	}
+
+	names := make([]string, 0, len(header.Refs))
+	for _, ref := range header.Refs {
+		names = append(names, ref.Name)
+	}
+	return bam.Reference{}, fmt.Errorf("none of the mitochondrial contig names %s is in the header of %s, which has %s; set mt_contig_aliases to the name used by its reference",
+		strings.Join(aliases, ", "), input, strings.Join(names, ", "))
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	"scVarCall/bam"
+
+	"github.com/spf13/viper"
+)
+
+// dedupStats are the reads of a cell before and after deduplication, a pair
+// counting as one read
+type dedupStats struct {
+	Reads_in       int
+	Reads_out      int
+	Duplicate_rate float64
+}
+
+// useNativeDedup tells whether step 5 deduplicates the UMIs in process rather
+// than with umi_tools
+func useNativeDedup() bool {
+	return viper.GetString("dedup_engine") == "native"
+}
+
+// dedupBundleKey is what reads must share, along with their position, to be
+// duplicates of each other. Reads of a pair are grouped by their read 1,
+// which must also have the same template length.
+type dedupBundleKey struct {
+	cell string
+	tlen int
+}
+
+// dedupUMI is a UMI seen at a position, the read kept for it being the one
+// with the highest mapping quality
+type dedupUMI struct {
+	count int
+	best  *bam.Record
+	mated []string // names of its reads whose mate is waiting on the decision
+}
+
+// dedupBucketKey is where umi_tools considers reads to start, on their strand
+type dedupBucketKey struct {
+	pos     int
+	reverse bool
+}
+
+// dedupBucket holds the reads starting at the same position on the same strand
+type dedupBucket struct {
+	bundles map[dedupBundleKey]map[string]*dedupUMI
+	min_pos int // leftmost alignment of its reads
+}
+
+// keptReads sorts the reads to write by position, in the order they were kept
+type keptReads struct {
+	reads  []*bam.Record
+	order  []int
+	pushed int
+}
+
+func (kept *keptReads) Len() int { return len(kept.reads) }
+func (kept *keptReads) Less(i, j int) bool {
+	if kept.reads[i].Pos != kept.reads[j].Pos {
+		return kept.reads[i].Pos < kept.reads[j].Pos
+	}
+	return kept.order[i] < kept.order[j]
+}
+func (kept *keptReads) Swap(i, j int) {
+	kept.reads[i], kept.reads[j] = kept.reads[j], kept.reads[i]
+	kept.order[i], kept.order[j] = kept.order[j], kept.order[i]
+}
+func (kept *keptReads) Push(x interface{}) {
+	kept.reads = append(kept.reads, x.(*bam.Record))
+	kept.order = append(kept.order, kept.pushed)
+	kept.pushed++
+}
+func (kept *keptReads) Pop() interface{} {
+	last := len(kept.reads) - 1
+	rec := kept.reads[last]
+	kept.reads = kept.reads[:last]
+	kept.order = kept.order[:last]
+	return rec
+}
+
+// umiDeduplicator removes the PCR duplicates of a coordinate sorted bam the
+// way umi_tools dedup --per-cell --paired does: reads of a cell on the same
+// strand and starting at the same position, once soft clipping is accounted
+// for, are grouped by UMI and only one read is kept per UMI cluster. Pairs are
+// deduplicated on their read 1, its mate being kept or removed along with it.
+// Positions are processed as the reads go past them so only a window of reads
+// is kept.
+type umiDeduplicator struct {
+	method        string
+	edit_distance int
+
+	ref_id       int
+	last_pos     int
+	longest_read int // bounds the soft clips of the reads still to come
+	buckets      map[dedupBucketKey]*dedupBucket
+	kept         keptReads
+	reads_n      int
+	kept_n       int
+	writer       *bam.Writer
+	stats        map[string]dedupStats
+	skipped      int // reads without a cell barcode or UMI, and their mates
+
+	// mates of read 1s that weren't deduplicated yet, and whether the read 1s
+	// that were are kept, until their mate is seen
+	pending_mates  map[string]*bam.Record
+	mate_decisions map[string]bool
+}
+
+// dedupPosition is where umi_tools considers a read to start: the 5' end of
+// the read on its strand, including any soft clipped bases
+func dedupPosition(rec *bam.Record) int {
+	if rec.Flag&bam.FlagReverse != 0 {
+		end := rec.End()
+		if n := len(rec.Cigar); n > 0 && rec.Cigar[n-1].Type() == 'S' {
+			end += rec.Cigar[n-1].Len()
+		}
+		return end
+	}
+	pos := rec.Pos
+	if len(rec.Cigar) > 0 && rec.Cigar[0].Type() == 'S' {
+		pos -= rec.Cigar[0].Len()
+	}
+	return pos
+}
+
+// isMated tells whether a read is deduplicated along with its mate, which
+// needs to be mapped to the same contig. Other reads are deduplicated on their own.
+func isMated(rec *bam.Record) bool {
+	return rec.Flag&bam.FlagPaired != 0 && rec.Flag&bam.FlagMateUnmapped == 0 && rec.Next_ref_id == rec.Ref_id
+}
+
+func isRead1(rec *bam.Record) bool {
+	return rec.Flag&bam.FlagRead2 == 0
+}
+
+func (dedup *umiDeduplicator) add(rec *bam.Record) error {
+	if rec.Flag&(bam.FlagUnmapped|bam.FlagSecondary|bam.FlagSupplementary) != 0 || rec.Ref_id < 0 {
+		return nil
+	}
+
+	dedup.reads_n++
+	if len(rec.Seq) > dedup.longest_read {
+		dedup.longest_read = len(rec.Seq)
+	}
+
+	if rec.Ref_id != dedup.ref_id {
+		if err := dedup.flushContig(); err != nil {
+			return err
+		}
+		dedup.ref_id = rec.Ref_id
+		dedup.last_pos = -1
+	}
+	if rec.Pos > dedup.last_pos {
+		if err := dedup.flush(rec.Pos, false); err != nil {
+			return err
+		}
+		dedup.last_pos = rec.Pos
+	}
+
+	if isMated(rec) && !isRead1(rec) {
+		dedup.addMate(rec)
+		return nil
+	}
+
+	cell_barcode, has_cell := rec.TagString("CB")
+	umi, has_umi := rec.TagString("UB")
+	if !has_cell || !has_umi {
+		dedup.skipped++
+		if isMated(rec) {
+			dedup.decideMate(rec.Name, false)
+		}
+		return nil
+	}
+
+	stats := dedup.stats[cell_barcode]
+	stats.Reads_in++
+	dedup.stats[cell_barcode] = stats
+
+	bucket_key := dedupBucketKey{pos: dedupPosition(rec), reverse: rec.Flag&bam.FlagReverse != 0}
+	bucket, found := dedup.buckets[bucket_key]
+	if !found {
+		bucket = &dedupBucket{bundles: make(map[dedupBundleKey]map[string]*dedupUMI), min_pos: rec.Pos}
+		dedup.buckets[bucket_key] = bucket
+	}
+	if rec.Pos < bucket.min_pos {
+		bucket.min_pos = rec.Pos
+	}
+
+	key := dedupBundleKey{cell: cell_barcode}
+	if isMated(rec) {
+		key.tlen = rec.Tlen
+	}
+	umis, found := bucket.bundles[key]
+	if !found {
+		umis = make(map[string]*dedupUMI)
+		bucket.bundles[key] = umis
+	}
+	seen, found := umis[umi]
+	if !found {
+		seen = &dedupUMI{}
+		umis[umi] = seen
+	}
+	seen.count++
+	if seen.best == nil || rec.Mapq > seen.best.Mapq {
+		seen.best = rec
+	}
+	if isMated(rec) {
+		seen.mated = append(seen.mated, rec.Name)
+	}
+	return nil
+}
+
+// addMate keeps the mate of a read 1 if it was kept, or holds on to it until
+// its read 1 is deduplicated
+func (dedup *umiDeduplicator) addMate(rec *bam.Record) {
+	keep, decided := dedup.mate_decisions[rec.Name]
+	if !decided {
+		dedup.pending_mates[rec.Name] = rec
+		return
+	}
+	delete(dedup.mate_decisions, rec.Name)
+	if keep {
+		heap.Push(&dedup.kept, rec)
+	}
+}
+
+// decideMate keeps or removes the mate of a read 1 once the read 1 was
+// deduplicated, or remembers what to do with it if it wasn't seen yet
+func (dedup *umiDeduplicator) decideMate(name string, keep bool) {
+	mate, pending := dedup.pending_mates[name]
+	if !pending {
+		dedup.mate_decisions[name] = keep
+		return
+	}
+	delete(dedup.pending_mates, name)
+	if keep {
+		heap.Push(&dedup.kept, mate)
+	}
+}
+
+// flushContig writes out the reads left once all the reads of a contig were
+// seen, dropping the mates whose read 1 never came
+func (dedup *umiDeduplicator) flushContig() error {
+	if err := dedup.flush(-1, true); err != nil {
+		return err
+	}
+	dedup.skipped += len(dedup.pending_mates)
+	dedup.pending_mates = make(map[string]*bam.Record)
+	dedup.mate_decisions = make(map[string]bool)
+	return nil
+}
+
+// flush deduplicates the buckets no read starting at the given position or
+// after it can join, or all of them, then writes out the kept reads no
+// remaining read can come before. A reverse read starts after its alignment,
+// so its bucket is done once reads start past it. A forward read starts at
+// most its length before its alignment, when soft clipped.
+func (dedup *umiDeduplicator) flush(before int, all bool) error {
+	var keys []dedupBucketKey
+	for key := range dedup.buckets {
+		if all || (key.reverse && key.pos < before) || (!key.reverse && key.pos < before-dedup.longest_read) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].pos != keys[j].pos {
+			return keys[i].pos < keys[j].pos
+		}
+		return !keys[i].reverse && keys[j].reverse
+	})
+
+	for _, bucket_key := range keys {
+		bucket := dedup.buckets[bucket_key]
+		delete(dedup.buckets, bucket_key)
+
+		for key, umis := range bucket.bundles {
+			counts := make(map[string]int, len(umis))
+			for umi, seen := range umis {
+				counts[umi] = seen.count
+			}
+			kept := dedup.cluster(counts)
+			kept_umis := make(map[string]bool, len(kept))
+			for _, umi := range kept {
+				heap.Push(&dedup.kept, umis[umi].best)
+				kept_umis[umi] = true
+			}
+			// the mate of the read kept for a UMI is kept with it
+			for umi, seen := range umis {
+				for _, name := range seen.mated {
+					dedup.decideMate(name, kept_umis[umi] && name == seen.best.Name)
+				}
+			}
+			stats := dedup.stats[key.cell]
+			stats.Reads_out += len(kept)
+			dedup.stats[key.cell] = stats
+		}
+	}
+
+	// reads of the buckets left, and mates waiting on them, may be placed
+	// before the ones kept so far
+	write_before := before
+	for _, bucket := range dedup.buckets {
+		if bucket.min_pos < write_before {
+			write_before = bucket.min_pos
+		}
+	}
+	for _, mate := range dedup.pending_mates {
+		if mate.Pos < write_before {
+			write_before = mate.Pos
+		}
+	}
+	for dedup.kept.Len() > 0 && (all || dedup.kept.reads[0].Pos < write_before) {
+		rec := heap.Pop(&dedup.kept).(*bam.Record)
+		if err := dedup.writer.Write(rec); err != nil {
+			return err
+		}
+		dedup.kept_n++
+	}
+	return nil
+}
+
+// cluster gives the UMI kept for each cluster of the UMIs found at a position
+func (dedup *umiDeduplicator) cluster(counts map[string]int) []string {
+	umis := make([]string, 0, len(counts))
+	for umi := range counts {
+		umis = append(umis, umi)
+	}
+	// most abundant first, as umi_tools goes through them
+	sort.Slice(umis, func(i, j int) bool {
+		if counts[umis[i]] != counts[umis[j]] {
+			return counts[umis[i]] > counts[umis[j]]
+		}
+		return umis[i] < umis[j]
+	})
+	if dedup.method == "unique" || len(umis) == 1 {
+		return umis
+	}
+	return directionalClusters(umis, counts, dedup.edit_distance)
+}
+
+// directionalClusters is the directional method of umi_tools: a UMI is
+// absorbed by one within the edit distance having at least twice its count
+// minus one, and so on from there. Each cluster is represented by the most
+// abundant UMI it started from, umis being sorted by decreasing count.
+func directionalClusters(umis []string, counts map[string]int, edit_distance int) []string {
+	adjacent := make(map[string][]string, len(umis))
+	for i, umi_a := range umis {
+		for _, umi_b := range umis[i+1:] {
+			if hammingDistance(umi_a, umi_b) > edit_distance {
+				continue
+			}
+			if counts[umi_a] >= 2*counts[umi_b]-1 {
+				adjacent[umi_a] = append(adjacent[umi_a], umi_b)
+			}
+			if counts[umi_b] >= 2*counts[umi_a]-1 {
+				adjacent[umi_b] = append(adjacent[umi_b], umi_a)
+			}
+		}
+	}
+
+	var representatives []string
+	found := make(map[string]bool, len(umis))
+	for _, umi := range umis {
+		if found[umi] {
+			continue
+		}
+		representatives = append(representatives, umi)
+		found[umi] = true
+		queue := []string{umi}
+		for len(queue) > 0 {
+			node := queue[0]
+			queue = queue[1:]
+			for _, next := range adjacent[node] {
+				if !found[next] {
+					found[next] = true
+					queue = append(queue, next)
+				}
+			}
+		}
+	}
+	return representatives
+}
+
+// hammingDistance between two UMIs, UMIs of different lengths never being
+// within any edit distance of each other
+func hammingDistance(umi_a string, umi_b string) int {
+	if len(umi_a) != len(umi_b) {
+		return len(umi_a) + len(umi_b)
+	}
+	distance := 0
+	for i := 0; i < len(umi_a); i++ {
+		if umi_a[i] != umi_b[i] {
+			distance++
+		}
+	}
+	return distance
+}
+
+// dedupBam writes the reads of a coordinate sorted bam left once its UMI
+// duplicates are removed, returning the reads in and out of every cell
+func dedupBam(input_path string, output_path string, method string, edit_distance int) (map[string]dedupStats, error) {
+	input, err := os.Open(input_path)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	reader, err := bam.NewReader(bufio.NewReaderSize(input, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", input_path, err)
+	}
+
+	output, err := os.Create(output_path)
+	if err != nil {
+		return nil, err
+	}
+	defer output.Close()
+	buffered := bufio.NewWriterSize(output, 1<<20)
+
+	writer, err := bam.NewWriter(buffered, reader.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	dedup := &umiDeduplicator{
+		method:         method,
+		edit_distance:  edit_distance,
+		ref_id:         -1,
+		buckets:        make(map[dedupBucketKey]*dedupBucket),
+		writer:         writer,
+		stats:          make(map[string]dedupStats),
+		pending_mates:  make(map[string]*bam.Record),
+		mate_decisions: make(map[string]bool),
+	}
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", input_path, err)
+		}
+		if err := dedup.add(rec); err != nil {
+			return nil, err
+		}
+	}
+	if err := dedup.flushContig(); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := buffered.Flush(); err != nil {
+		return nil, err
+	}
+
+	for cell_barcode, stats := range dedup.stats {
+		stats.Duplicate_rate = 1 - float64(stats.Reads_out)/float64(stats.Reads_in)
+		dedup.stats[cell_barcode] = stats
+	}
+	log.Println(fmt.Sprintf("Kept %d of %d reads of %d cells, skipped %d reads without CB or UB tags", dedup.kept_n, dedup.reads_n, len(dedup.stats), dedup.skipped))
+	return dedup.stats, nil
+}
+
+// nativeUMIDedupJob deduplicates the UMIs in process, the duplicate rates of
+// the cells being put in stats
+func nativeUMIDedupJob(qc_subset_bam string, deduped_bam string, stats *map[string]dedupStats) job {
+	method := viper.GetString("dedup_method")
+	edit_distance := viper.GetInt("dedup_edit_distance")
+	return job{
+		Name: "UMI_dedup",
+		Native: &nativeTask{
+			Description: fmt.Sprintf("remove the UMI duplicates of %s with the %s method into %s", qc_subset_bam, method, deduped_bam),
+			run: func() error {
+				var err error
+				*stats, err = dedupBam(qc_subset_bam, deduped_bam, method, edit_distance)
+				return err
+			},
+		},
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"scVarCall/bam"
+)
+
+func TestDirectionalClusters(t *testing.T) {
+	tests := []struct {
+		counts        map[string]int
+		edit_distance int
+		expected      []string
+	}{
+		// absorbed with twice the count less one, not above
+		{map[string]int{"AAAA": 10, "AAAT": 5}, 1, []string{"AAAA"}},
+		{map[string]int{"AAAA": 10, "AAAT": 6}, 1, []string{"AAAA", "AAAT"}},
+		// absorbed through an UMI of the cluster
+		{map[string]int{"AAAA": 20, "AAAT": 10, "AATT": 5}, 1, []string{"AAAA"}},
+		// UMIs seen once absorb each other
+		{map[string]int{"AAAT": 1, "AAAA": 1}, 1, []string{"AAAA"}},
+		// an UMI too close in count starts its own cluster, which takes the next one
+		{map[string]int{"AAAA": 10, "AAAT": 9, "AATT": 4}, 1, []string{"AAAA", "AAAT"}},
+		{map[string]int{"AAAA": 100, "AATT": 1}, 1, []string{"AAAA", "AATT"}},
+		{map[string]int{"AAAA": 100, "AATT": 1}, 2, []string{"AAAA"}},
+		{map[string]int{"AAAA": 100, "AAAAT": 1}, 1, []string{"AAAA", "AAAAT"}},
+		{map[string]int{"AAAA": 4, "CCCC": 3, "CCCG": 1, "GGGG": 2}, 1, []string{"AAAA", "CCCC", "GGGG"}},
+	}
+
+	for _, test := range tests {
+		dedup := &umiDeduplicator{method: "directional", edit_distance: test.edit_distance}
+		if kept := dedup.cluster(test.counts); !reflect.DeepEqual(kept, test.expected) {
+			t.Errorf("UMIs %v within %d gave %v, expected %v", test.counts, test.edit_distance, kept, test.expected)
+		}
+	}
+
+	dedup := &umiDeduplicator{method: "unique", edit_distance: 1}
+	if kept := dedup.cluster(map[string]int{"AAAA": 10, "AAAT": 1, "GGGG": 2}); !reflect.DeepEqual(kept, []string{"AAAA", "GGGG", "AAAT"}) {
+		t.Errorf("unique method kept %v, expected every UMI", kept)
+	}
+}
+
+// runTestDedup deduplicates a test bam, returning the names of the reads
+// kept, in the order they were written, and the stats of the cells
+func runTestDedup(t *testing.T, length int, reads []testRead) ([]string, map[string]dedupStats) {
+	t.Helper()
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.bam")
+	output := filepath.Join(dir, "deduped.bam")
+	writeMTBam(t, input, length, reads)
+
+	stats, err := dedupBam(input, output, "directional", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := bam.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	last_pos := -1
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Pos < last_pos {
+			t.Errorf("read %s at %d written after a read at %d", rec.Name, rec.Pos, last_pos)
+		}
+		last_pos = rec.Pos
+		names = append(names, rec.Name)
+	}
+	return names, stats
+}
+
+func TestDedupBamSingleEnd(t *testing.T) {
+	seq := strings.Repeat("A", 10)
+	reads := []testRead{
+		// the read with the highest mapping quality is kept for a UMI
+		{name: "a_low", cell: "AAAC-1", pos: 10, cigar: "10M", seq: seq, umi: "AAAA", mapq: 20},
+		{name: "a_best", cell: "AAAC-1", pos: 10, cigar: "10M", seq: seq, umi: "AAAA", mapq: 60},
+		{name: "a_other", cell: "AAAC-1", pos: 10, cigar: "10M", seq: seq, umi: "AAAA", mapq: 30},
+		// absorbed by AAAA
+		{name: "a_error", cell: "AAAC-1", pos: 10, cigar: "10M", seq: seq, umi: "AAAT", mapq: 60},
+		// starts at 10 once its soft clip is counted
+		{name: "a_clipped", cell: "AAAC-1", pos: 12, cigar: "2S8M", seq: seq, umi: "AAAA", mapq: 60},
+		{name: "g", cell: "AAAC-1", pos: 10, cigar: "10M", seq: seq, umi: "GGGG", mapq: 60},
+		// another cell, then the other strand
+		{name: "other_cell", cell: "GGGT-1", pos: 10, cigar: "10M", seq: seq, umi: "AAAA", mapq: 60},
+		{name: "reverse", cell: "AAAC-1", pos: 10, cigar: "10M", seq: seq, umi: "AAAA", mapq: 60, reverse: true},
+		// reverse reads ending at the same position, one of them spanning a
+		// deletion longer than the reads between them
+		{name: "long_deletion", cell: "AAAC-1", pos: 100, cigar: "5M1500D5M", seq: seq, umi: "CCCC", mapq: 60, reverse: true},
+		{name: "far", cell: "AAAC-1", pos: 1200, cigar: "10M", seq: seq, umi: "CCCC", mapq: 60},
+		{name: "same_end", cell: "AAAC-1", pos: 1600, cigar: "10M", seq: seq, umi: "CCCC", mapq: 10, reverse: true},
+		{name: "no_umi", cell: "AAAC-1", pos: 10, cigar: "10M", seq: seq, mapq: 60},
+	}
+	names, stats := runTestDedup(t, 5000, reads)
+
+	expected := map[string]bool{"a_best": true, "g": true, "other_cell": true, "reverse": true, "long_deletion": true, "far": true}
+	if len(names) != len(expected) {
+		t.Errorf("kept %v, expected %v", names, expected)
+	}
+	for _, name := range names {
+		if !expected[name] {
+			t.Errorf("kept %s, expected only %v", name, expected)
+		}
+	}
+
+	if cell := stats["AAAC-1"]; cell.Reads_in != 10 || cell.Reads_out != 5 || cell.Duplicate_rate != 0.5 {
+		t.Errorf("got stats %+v for AAAC-1, expected 10 reads in and 5 out", cell)
+	}
+	if cell := stats["GGGT-1"]; cell.Reads_in != 1 || cell.Reads_out != 1 {
+		t.Errorf("got stats %+v for GGGT-1, expected 1 read in and out", cell)
+	}
+}
+
+func TestDedupBamPairs(t *testing.T) {
+	seq := strings.Repeat("A", 10)
+	read1 := uint16(bam.FlagPaired | bam.FlagRead1)
+	read2 := uint16(bam.FlagPaired | bam.FlagRead2)
+	reads := []testRead{
+		// p2 is a duplicate of p1 and goes with its mate, p3 has another template length
+		{name: "p1", cell: "AAAC-1", pos: 10, cigar: "10M", seq: seq, umi: "AAAA", mapq: 60, flag: read1, mate_pos: 100, tlen: 100},
+		{name: "p1", cell: "AAAC-1", pos: 100, cigar: "10M", seq: seq, mapq: 60, reverse: true, flag: read2, mate_pos: 10, tlen: -100},
+		{name: "p2", cell: "AAAC-1", pos: 10, cigar: "10M", seq: seq, umi: "AAAA", mapq: 20, flag: read1, mate_pos: 100, tlen: 100},
+		{name: "p2", cell: "AAAC-1", pos: 100, cigar: "10M", seq: seq, mapq: 60, reverse: true, flag: read2, mate_pos: 10, tlen: -100},
+		{name: "p3", cell: "AAAC-1", pos: 10, cigar: "10M", seq: seq, umi: "AAAA", mapq: 60, flag: read1, mate_pos: 150, tlen: 150},
+		{name: "p3", cell: "AAAC-1", pos: 150, cigar: "10M", seq: seq, mapq: 60, reverse: true, flag: read2, mate_pos: 10, tlen: -150},
+		// read 2 placed before its read 1, p5 being a duplicate of p4
+		{name: "p4", cell: "AAAC-1", pos: 5, cigar: "10M", seq: seq, mapq: 60, flag: read2, mate_pos: 50, tlen: 55},
+		{name: "p4", cell: "AAAC-1", pos: 50, cigar: "10M", seq: seq, umi: "GGGG", mapq: 60, reverse: true, flag: read1, mate_pos: 5, tlen: -55},
+		{name: "p5", cell: "AAAC-1", pos: 5, cigar: "10M", seq: seq, mapq: 60, flag: read2, mate_pos: 50, tlen: 55},
+		{name: "p5", cell: "AAAC-1", pos: 50, cigar: "10M", seq: seq, umi: "GGGG", mapq: 10, reverse: true, flag: read1, mate_pos: 5, tlen: -55},
+		// a read 1 without UMI takes its mate with it
+		{name: "no_umi", cell: "AAAC-1", pos: 20, cigar: "10M", seq: seq, mapq: 60, flag: read1, mate_pos: 30, tlen: 20},
+		{name: "no_umi", cell: "AAAC-1", pos: 30, cigar: "10M", seq: seq, mapq: 60, reverse: true, flag: read2, mate_pos: 20, tlen: -20},
+		// deduplicated on its own as its mate is unmapped
+		{name: "single", cell: "AAAC-1", pos: 10, cigar: "10M", seq: seq, umi: "AAAA", mapq: 60, flag: read1 | bam.FlagMateUnmapped},
+	}
+	names, stats := runTestDedup(t, 1000, reads)
+
+	counts := make(map[string]int)
+	for _, name := range names {
+		counts[name]++
+	}
+	expected := map[string]int{"p1": 2, "p3": 2, "p4": 2, "single": 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("kept reads %v, expected %v", counts, expected)
+	}
+
+	if cell := stats["AAAC-1"]; cell.Reads_in != 6 || cell.Reads_out != 4 {
+		t.Errorf("got stats %+v for AAAC-1, expected 6 reads in and 4 out", cell)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// job describes a single command to be run by an executor, along with the
+// resources it should request and where its stdout/stderr should be written
+type job struct {
+	Name     string
+	Command  []string
+	Pipeline *pipeline   // run instead of Command when set
+	Native   *nativeTask // run in the pipeline process instead of being submitted
+	Stdout   string
+	Stderr   string
+	Memory   int // in MB, 0 leaves it to the backend default
+	Cores    int
+	Walltime time.Duration // 0 leaves it to the backend default
+	Queue    string
+	// passed as is to the scheduler, for the options not covered above
+	Extra_args []string
+}
+
+type jobState string
+
+const (
+	jobPending jobState = "PENDING"
+	jobRunning jobState = "RUNNING"
+	jobDone    jobState = "DONE"
+	jobFailed  jobState = "FAILED"
+	jobUnknown jobState = "UNKNOWN"
+)
+
+// reasons given by executors for a job that was killed for going over its resources
+const (
+	killedMemLimit = "MEMLIMIT"
+	killedRunLimit = "RUNLIMIT"
+)
+
+// jobStatus is everything an executor can tell us about a submitted job
+type jobStatus struct {
+	State     jobState
+	Exit_code int
+	Reason    string
+}
+
+func (status jobStatus) finished() bool {
+	return status.State == jobDone || status.State == jobFailed
+}
+
+// executor is implemented by every backend that can run the commands of the
+// pipeline, be it a scheduler like LSF or the local machine
+type executor interface {
+	// Submit queues the job and returns an ID that can be used with the other methods
+	Submit(j job) (string, error)
+	// Status returns the current state of a previously submitted job
+	Status(job_id string) (jobStatus, error)
+	// Wait blocks until the job has either completed or failed
+	Wait(job_id string) (jobStatus, error)
+	// Cancel kills the job if it is still pending or running
+	Cancel(job_id string) error
+}
+
+// arrayExecutor is implemented by backends that can submit many tasks of the
+// same job at once. Every array_index_placeholder in the name, output paths
+// and command of the job is replaced by the index of the task, from 1 to tasks.
+type arrayExecutor interface {
+	SubmitArray(j job, tasks int) (string, error)
+	// TaskID returns the ID of a single task, to be used with Status and Cancel
+	TaskID(array_id string, task_index int) string
+}
+
+const array_index_placeholder = "{TASK_INDEX}"
+
+// arrayTask returns the job of a single task of an array, the index can be a
+// number or the variable a scheduler sets it in
+func arrayTask(j job, task_index string) job {
+	task := j
+	task.Name = strings.ReplaceAll(j.Name, array_index_placeholder, task_index)
+	task.Stdout = strings.ReplaceAll(j.Stdout, array_index_placeholder, task_index)
+	task.Stderr = strings.ReplaceAll(j.Stderr, array_index_placeholder, task_index)
+	task.Command = make([]string, len(j.Command))
+	for i, arg := range j.Command {
+		task.Command[i] = strings.ReplaceAll(arg, array_index_placeholder, task_index)
+	}
+	return task
+}
+
+var job_executor executor
+
+// how long Wait implementations sleep between each status check
+var job_poll_interval = 5 * time.Second
+
+// newExecutor returns the backend matching the "executor" config value
+func newExecutor(name string) (executor, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "lsf", "bsub":
+		return newLsfExecutor(), nil
+	case "slurm", "sbatch":
+		return newSlurmExecutor(), nil
+	case "local":
+		return newLocalExecutor(viper.GetInt("local_max_jobs")), nil
+	}
+	return nil, fmt.Errorf("unknown executor '%s'", name)
+}
+
+// pollUntilFinished calls the status function of an executor until the job has
+// either completed or failed
+func pollUntilFinished(job_id string, status_func func(string) (jobStatus, error)) (jobStatus, error) {
+	for {
+		status, err := status_func(job_id)
+		if err != nil {
+			return status, err
+		}
+		if status.finished() {
+			return status, nil
+		}
+		time.Sleep(job_poll_interval)
+	}
+}
+
+// runJob submits a job through the configured executor and blocks until it has
+// finished, recording it on the owner barcode and returning an error if it
+// didn't complete successfully
+func runJob(j job, owner *barcode) error {
+	if j.Native != nil {
+		return runNative(j, owner)
+	}
+
+	log.Println(fmt.Sprintf("Submitting job %s", j.Name))
+
+	tracker := newJobTracker()
+	tracker.enqueue(j.Name, j)
+
+	var record jobRecord
+	err := tracker.waitAll(func(key string, finished jobRecord) {
+		record = finished
+	})
+	owner.recordJob(j.Name, record)
+	if err != nil {
+		return err
+	}
+
+	if record.State != jobDone {
+		return fmt.Errorf("job %s (%s) finished with state %s and exit code %d", record.Job_id, j.Name, record.State, record.Exit_code)
+	}
+	return nil
+}
+
+// commandLine is the shell equivalent of what the job runs
+func commandLine(j job) string {
+	if j.Native != nil {
+		return j.Native.Description
+	}
+	if j.Pipeline != nil {
+		return j.Pipeline.String()
+	}
+	return shellJoin(j.Command)
+}
+
+// schedulerCommand is the command to submit to a scheduler for the job. As
+// pipelines can't be run with Go pipes on another node, they are handed to
+// bash with pipefail so a failure of any stage still fails the job.
+func schedulerCommand(j job) []string {
+	if j.Pipeline != nil {
+		return []string{"bash", "-o", "pipefail", "-c", j.Pipeline.String()}
+	}
+	return j.Command
+}
+
+var shell_safe_regex = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// the task index of job arrays is passed as a reference to the variable the
+// scheduler sets, which needs to be expanded by the job shell
+var shell_variable_regex = regexp.MustCompile(`^\$[A-Za-z_][A-Za-z0-9_]*$`)
+
+// shellJoin quotes every argument of a command so it can be handed to a
+// scheduler that runs it through a shell, like bsub or sbatch --wrap
+func shellJoin(command []string) string {
+	quoted := make([]string, len(command))
+	for i, arg := range command {
+		if shell_safe_regex.MatchString(arg) || shell_variable_regex.MatchString(arg) {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
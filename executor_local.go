@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zenthangplus/goccm"
+)
+
+type localJob struct {
+	running   *runningPipeline
+	status    jobStatus
+	cancelled bool
+	killed    string // set when the job is killed for going over its walltime
+	done      chan struct{}
+}
+
+// localExecutor runs jobs as child processes of the pipeline, with at most
+// max_jobs of them running at the same time. Memory and core requests are
+// not enforced, so max_jobs should be set with the heaviest step in mind.
+type localExecutor struct {
+	pool goccm.ConcurrencyManager
+
+	mu      sync.Mutex
+	jobs    map[string]*localJob
+	arrays  map[string][]string // array ID to the job IDs of its tasks
+	last_id int
+}
+
+func newLocalExecutor(max_jobs int) *localExecutor {
+	if max_jobs < 1 {
+		max_jobs = 1
+	}
+	return &localExecutor{
+		pool:   goccm.New(max_jobs),
+		jobs:   make(map[string]*localJob),
+		arrays: make(map[string][]string),
+	}
+}
+
+func (local *localExecutor) Submit(j job) (string, error) {
+	if len(j.Command) == 0 && j.Pipeline == nil {
+		return "", fmt.Errorf("job %s has no command to run", j.Name)
+	}
+
+	local.mu.Lock()
+	local.last_id++
+	job_id := "local_" + strconv.Itoa(local.last_id)
+	lj := &localJob{
+		status: jobStatus{State: jobPending},
+		done:   make(chan struct{}),
+	}
+	local.jobs[job_id] = lj
+	local.mu.Unlock()
+
+	go local.run(j, lj)
+
+	return job_id, nil
+}
+
+// SubmitArray submits every task as its own job, sharing the pool with all other jobs
+func (local *localExecutor) SubmitArray(j job, tasks int) (string, error) {
+	var task_ids []string
+	for task_index := 1; task_index <= tasks; task_index++ {
+		task_id, err := local.Submit(arrayTask(j, strconv.Itoa(task_index)))
+		if err != nil {
+			return "", err
+		}
+		task_ids = append(task_ids, task_id)
+	}
+
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	local.last_id++
+	array_id := "local_array_" + strconv.Itoa(local.last_id)
+	local.arrays[array_id] = task_ids
+	return array_id, nil
+}
+
+func (local *localExecutor) TaskID(array_id string, task_index int) string {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	task_ids := local.arrays[array_id]
+	if task_index < 1 || task_index > len(task_ids) {
+		return ""
+	}
+	return task_ids[task_index-1]
+}
+
+// run waits for a free slot in the pool then runs the job, writing its output
+// to the same .o/.e files a scheduler would and killing it if it runs longer
+// than its walltime. Plain commands are run as a pipeline of a single stage.
+func (local *localExecutor) run(j job, lj *localJob) {
+	local.pool.Wait()
+	defer local.pool.Done()
+	defer close(lj.done)
+
+	local.mu.Lock()
+	cancelled := lj.cancelled
+	local.mu.Unlock()
+	if cancelled {
+		local.finish(lj, jobStatus{State: jobFailed, Exit_code: -1})
+		return
+	}
+
+	job_pipeline := j.Pipeline
+	if job_pipeline == nil {
+		job_pipeline = newPipeline(j.Command...)
+	}
+
+	// a job whose output can't be written fails like it would on a scheduler
+	var stdout, stderr io.Writer = ioutil.Discard, ioutil.Discard
+	if j.Stdout != "" {
+		stdout_file, err := os.Create(j.Stdout)
+		if err != nil {
+			local.finish(lj, jobStatus{State: jobFailed, Exit_code: -1, Reason: err.Error()})
+			return
+		}
+		defer stdout_file.Close()
+		stdout = stdout_file
+	}
+	if j.Stderr != "" {
+		stderr_file, err := os.Create(j.Stderr)
+		if err != nil {
+			local.finish(lj, jobStatus{State: jobFailed, Exit_code: -1, Reason: err.Error()})
+			return
+		}
+		defer stderr_file.Close()
+		stderr = stderr_file
+	}
+
+	running, err := job_pipeline.start(stdout, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		local.finish(lj, jobStatus{State: jobFailed, Exit_code: -1})
+		return
+	}
+
+	local.mu.Lock()
+	lj.running = running
+	lj.status.State = jobRunning
+	// the job may have been cancelled while it was being started
+	if lj.cancelled {
+		running.kill()
+	}
+	local.mu.Unlock()
+
+	if j.Walltime > 0 {
+		walltime_timer := time.AfterFunc(j.Walltime, func() {
+			local.mu.Lock()
+			defer local.mu.Unlock()
+			lj.killed = killedRunLimit
+			running.kill()
+		})
+		defer walltime_timer.Stop()
+	}
+
+	err = running.wait()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		status := jobStatus{State: jobFailed, Exit_code: -1}
+		var exit_err *exec.ExitError
+		if errors.As(err, &exit_err) {
+			status.Exit_code = exit_err.ExitCode()
+		}
+		local.mu.Lock()
+		status.Reason = lj.killed
+		local.mu.Unlock()
+		local.finish(lj, status)
+		return
+	}
+	local.finish(lj, jobStatus{State: jobDone, Exit_code: 0})
+}
+
+// finish records the final status of a job
+func (local *localExecutor) finish(lj *localJob, status jobStatus) {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	lj.status = status
+}
+
+func (local *localExecutor) get(job_id string) (*localJob, error) {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	lj, ok := local.jobs[job_id]
+	if !ok {
+		return nil, fmt.Errorf("no local job with ID %s", job_id)
+	}
+	return lj, nil
+}
+
+func (local *localExecutor) Status(job_id string) (jobStatus, error) {
+	lj, err := local.get(job_id)
+	if err != nil {
+		return jobStatus{State: jobUnknown}, err
+	}
+
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	return lj.status, nil
+}
+
+func (local *localExecutor) Wait(job_id string) (jobStatus, error) {
+	lj, err := local.get(job_id)
+	if err != nil {
+		return jobStatus{State: jobUnknown}, err
+	}
+
+	<-lj.done
+	return local.Status(job_id)
+}
+
+func (local *localExecutor) Cancel(job_id string) error {
+	lj, err := local.get(job_id)
+	if err != nil {
+		return err
+	}
+
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	lj.cancelled = true
+	if lj.status.State == jobRunning && lj.running != nil {
+		lj.running.kill()
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+var lsf_jobid_regex = regexp.MustCompile(`Job <(\d+)> is submitted`)
+var lsf_exitcode_regex = regexp.MustCompile(`Exited with exit code (\d+)`)
+
+// lsfExecutor submits jobs to an LSF farm with bsub and follows them with bjobs
+type lsfExecutor struct {
+	bsub_exec  string
+	bjobs_exec string
+	bkill_exec string
+
+	// bjobs forgets about finished jobs after a while, so we keep where each
+	// job writes its output to fall back on reading the LSF report in it
+	mu       sync.Mutex
+	job_logs map[string]string
+}
+
+func newLsfExecutor() *lsfExecutor {
+	return &lsfExecutor{
+		bsub_exec:  viper.GetString("bsub_exec"),
+		bjobs_exec: viper.GetString("bjobs_exec"),
+		bkill_exec: viper.GetString("bkill_exec"),
+		job_logs:   make(map[string]string),
+	}
+}
+
+func (lsf *lsfExecutor) Submit(j job) (string, error) {
+	bsub_args := []string{"-J", j.Name}
+	if j.Stdout != "" {
+		bsub_args = append(bsub_args, "-o", j.Stdout)
+	}
+	if j.Stderr != "" {
+		bsub_args = append(bsub_args, "-e", j.Stderr)
+	}
+	if j.Memory > 0 {
+		bsub_args = append(bsub_args,
+			"-R", fmt.Sprintf("select[mem>%d] rusage[mem=%d]", j.Memory, j.Memory),
+			fmt.Sprintf("-M%d", j.Memory))
+	}
+	if j.Cores > 0 {
+		bsub_args = append(bsub_args, "-n", strconv.Itoa(j.Cores))
+	}
+	if j.Walltime > 0 {
+		bsub_args = append(bsub_args, "-W", strconv.Itoa(int(math.Ceil(j.Walltime.Minutes()))))
+	}
+	if j.Queue != "" {
+		bsub_args = append(bsub_args, "-q", j.Queue)
+	}
+	bsub_args = append(bsub_args, j.Extra_args...)
+	// bsub runs the command through a shell, so quote it to have it run as given
+	bsub_args = append(bsub_args, shellJoin(schedulerCommand(j)))
+
+	output, err := exec.Command(lsf.bsub_exec, bsub_args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("bsub failed for job %s: %s: %s", j.Name, err, strings.TrimSpace(string(output)))
+	}
+
+	match := lsf_jobid_regex.FindStringSubmatch(string(output))
+	if match == nil {
+		return "", fmt.Errorf("unable to parse job ID from bsub output: %s", strings.TrimSpace(string(output)))
+	}
+
+	lsf.mu.Lock()
+	lsf.job_logs[match[1]] = j.Stdout
+	lsf.mu.Unlock()
+
+	return match[1], nil
+}
+
+// SubmitArray submits the tasks as a single LSF job array, each task getting
+// its index through LSB_JOBINDEX
+func (lsf *lsfExecutor) SubmitArray(j job, tasks int) (string, error) {
+	array_job := arrayTask(j, "$LSB_JOBINDEX")
+	array_job.Name = fmt.Sprintf("%s[1-%d]", strings.ReplaceAll(j.Name, array_index_placeholder, ""), tasks)
+	array_job.Stdout = strings.ReplaceAll(j.Stdout, array_index_placeholder, "%I")
+	array_job.Stderr = strings.ReplaceAll(j.Stderr, array_index_placeholder, "%I")
+
+	array_id, err := lsf.Submit(array_job)
+	if err != nil {
+		return "", err
+	}
+
+	lsf.mu.Lock()
+	for task_index := 1; task_index <= tasks; task_index++ {
+		lsf.job_logs[lsf.TaskID(array_id, task_index)] = arrayTask(j, strconv.Itoa(task_index)).Stdout
+	}
+	lsf.mu.Unlock()
+
+	return array_id, nil
+}
+
+func (lsf *lsfExecutor) TaskID(array_id string, task_index int) string {
+	return fmt.Sprintf("%s[%d]", array_id, task_index)
+}
+
+func (lsf *lsfExecutor) Status(job_id string) (jobStatus, error) {
+	output, err := exec.Command(lsf.bjobs_exec, "-noheader", "-o", "stat exit_code exit_reason delimiter='|'", job_id).CombinedOutput()
+	fields := strings.Split(strings.TrimSpace(string(output)), "|")
+	if err == nil && fields[0] != "" && !strings.Contains(string(output), "not found") {
+		status := jobStatus{State: lsfState(fields[0])}
+		if len(fields) >= 2 {
+			if exit_code, err := strconv.Atoi(fields[1]); err == nil {
+				status.Exit_code = exit_code
+			}
+		}
+		if status.State == jobFailed && len(fields) >= 3 {
+			status.Reason = lsfKillReason(fields[2])
+		}
+		return status, nil
+	}
+
+	// when bjobs no longer knows the job, read the report LSF appends to the output file
+	lsf.mu.Lock()
+	job_log := lsf.job_logs[job_id]
+	lsf.mu.Unlock()
+	return lsfLogStatus(job_log), nil
+}
+
+func (lsf *lsfExecutor) Wait(job_id string) (jobStatus, error) {
+	return pollUntilFinished(job_id, lsf.Status)
+}
+
+func (lsf *lsfExecutor) Cancel(job_id string) error {
+	output, err := exec.Command(lsf.bkill_exec, job_id).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("bkill failed for job %s: %s: %s", job_id, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// lsfState converts the STAT column of bjobs into a jobState
+func lsfState(stat string) jobState {
+	switch stat {
+	case "PEND", "PSUSP", "WAIT":
+		return jobPending
+	case "RUN", "USUSP", "SSUSP", "PROV":
+		return jobRunning
+	case "DONE":
+		return jobDone
+	case "EXIT":
+		return jobFailed
+	}
+	return jobUnknown
+}
+
+// lsfLogStatus reads the job report written by LSF at the end of the job output
+func lsfLogStatus(job_log string) jobStatus {
+	if job_log == "" {
+		return jobStatus{State: jobUnknown}
+	}
+
+	dat, err := ioutil.ReadFile(job_log)
+	if err != nil || !strings.Contains(string(dat), "Terminated at") {
+		return jobStatus{State: jobUnknown}
+	}
+
+	if strings.Contains(string(dat), "Successfully completed.") {
+		return jobStatus{State: jobDone}
+	}
+
+	status := jobStatus{State: jobFailed, Exit_code: -1, Reason: lsfKillReason(string(dat))}
+	if match := lsf_exitcode_regex.FindStringSubmatch(string(dat)); match != nil {
+		status.Exit_code, _ = strconv.Atoi(match[1])
+	}
+	return status
+}
+
+// lsfKillReason looks for the termination reasons LSF gives when it kills a
+// job for going over its memory or run time limit
+func lsfKillReason(report string) string {
+	switch {
+	case strings.Contains(report, "TERM_MEMLIMIT"), strings.Contains(report, "memory usage limit"):
+		return killedMemLimit
+	case strings.Contains(report, "TERM_RUNLIMIT"), strings.Contains(report, "run limit"):
+		return killedRunLimit
+	}
+	return ""
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// slurmExecutor submits jobs with sbatch and follows them with sacct. The
+// paths to all three SLURM commands come from the config, which allows
+// pointing them at fake scripts to try the pipeline without a cluster.
+type slurmExecutor struct {
+	sbatch_exec  string
+	sacct_exec   string
+	scancel_exec string
+}
+
+func newSlurmExecutor() *slurmExecutor {
+	return &slurmExecutor{
+		sbatch_exec:  viper.GetString("sbatch_exec"),
+		sacct_exec:   viper.GetString("sacct_exec"),
+		scancel_exec: viper.GetString("scancel_exec"),
+	}
+}
+
+func (slurm *slurmExecutor) Submit(j job) (string, error) {
+	return slurm.submit(j)
+}
+
+func (slurm *slurmExecutor) submit(j job, extra_args ...string) (string, error) {
+	sbatch_args := append([]string{"--parsable", "-J", j.Name}, extra_args...)
+	if j.Stdout != "" {
+		sbatch_args = append(sbatch_args, "-o", j.Stdout)
+	}
+	if j.Stderr != "" {
+		sbatch_args = append(sbatch_args, "-e", j.Stderr)
+	}
+	if j.Memory > 0 {
+		sbatch_args = append(sbatch_args, fmt.Sprintf("--mem=%dM", j.Memory))
+	}
+	if j.Cores > 0 {
+		sbatch_args = append(sbatch_args, "--cpus-per-task="+strconv.Itoa(j.Cores))
+	}
+	if j.Walltime > 0 {
+		sbatch_args = append(sbatch_args, "--time="+strconv.Itoa(int(math.Ceil(j.Walltime.Minutes()))))
+	}
+	if j.Queue != "" {
+		sbatch_args = append(sbatch_args, "--partition="+j.Queue)
+	}
+	sbatch_args = append(sbatch_args, j.Extra_args...)
+	sbatch_args = append(sbatch_args, "--wrap", shellJoin(schedulerCommand(j)))
+
+	output, err := exec.Command(slurm.sbatch_exec, sbatch_args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("sbatch failed for job %s: %s: %s", j.Name, err, strings.TrimSpace(string(output)))
+	}
+
+	// --parsable prints "jobid" or "jobid;cluster"
+	job_id := strings.Split(strings.TrimSpace(string(output)), ";")[0]
+	if _, err := strconv.Atoi(job_id); err != nil {
+		return "", fmt.Errorf("unable to parse job ID from sbatch output: %s", strings.TrimSpace(string(output)))
+	}
+	return job_id, nil
+}
+
+// SubmitArray submits the tasks as a single SLURM job array, each task getting
+// its index through SLURM_ARRAY_TASK_ID
+func (slurm *slurmExecutor) SubmitArray(j job, tasks int) (string, error) {
+	array_job := arrayTask(j, "$SLURM_ARRAY_TASK_ID")
+	array_job.Name = strings.ReplaceAll(j.Name, array_index_placeholder, "")
+	array_job.Stdout = strings.ReplaceAll(j.Stdout, array_index_placeholder, "%a")
+	array_job.Stderr = strings.ReplaceAll(j.Stderr, array_index_placeholder, "%a")
+
+	return slurm.submit(array_job, fmt.Sprintf("--array=1-%d", tasks))
+}
+
+func (slurm *slurmExecutor) TaskID(array_id string, task_index int) string {
+	return fmt.Sprintf("%s_%d", array_id, task_index)
+}
+
+func (slurm *slurmExecutor) Status(job_id string) (jobStatus, error) {
+	output, err := exec.Command(slurm.sacct_exec, "-n", "-P", "-X", "-j", job_id, "-o", "State,ExitCode").CombinedOutput()
+	if err != nil {
+		return jobStatus{State: jobUnknown}, fmt.Errorf("sacct failed for job %s: %s: %s", job_id, err, strings.TrimSpace(string(output)))
+	}
+
+	// a job that was just submitted can take a moment to show up in sacct
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) == 0 || lines[0] == "" {
+		return jobStatus{State: jobUnknown}, nil
+	}
+
+	fields := strings.Split(lines[0], "|")
+	status := jobStatus{State: slurmState(fields[0])}
+	if len(fields) >= 2 {
+		// ExitCode is reported as "exit:signal"
+		exit_code, err := strconv.Atoi(strings.Split(fields[1], ":")[0])
+		if err == nil {
+			status.Exit_code = exit_code
+		}
+	}
+	if status.State == jobFailed && status.Exit_code == 0 {
+		status.Exit_code = -1
+	}
+	switch strings.Fields(fields[0] + " ")[0] {
+	case "OUT_OF_MEMORY":
+		status.Reason = killedMemLimit
+	case "TIMEOUT":
+		status.Reason = killedRunLimit
+	}
+	return status, nil
+}
+
+func (slurm *slurmExecutor) Wait(job_id string) (jobStatus, error) {
+	return pollUntilFinished(job_id, slurm.Status)
+}
+
+func (slurm *slurmExecutor) Cancel(job_id string) error {
+	output, err := exec.Command(slurm.scancel_exec, job_id).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("scancel failed for job %s: %s: %s", job_id, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// slurmState converts the State column of sacct into a jobState
+func slurmState(state string) jobState {
+	// cancelled jobs are reported as "CANCELLED by <uid>"
+	switch strings.Fields(state + " ")[0] {
+	case "PENDING", "REQUEUED", "RESIZING", "SUSPENDED":
+		return jobPending
+	case "RUNNING", "COMPLETING", "CONFIGURING", "STAGE_OUT", "SIGNALING":
+		return jobRunning
+	case "COMPLETED":
+		return jobDone
+	case "FAILED", "CANCELLED", "TIMEOUT", "OUT_OF_MEMORY", "NODE_FAIL", "PREEMPTED", "BOOT_FAIL", "DEADLINE":
+		return jobFailed
+	}
+	return jobUnknown
+}
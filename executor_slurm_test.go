@@ -0,0 +1,205 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// fakeSlurm writes sbatch and sacct scripts to a temporary directory and points
+// the config at them. sbatch records its arguments and prints the content of
+// sbatch_output, sacct prints the content of sacct_<job ID>.
+func fakeSlurm(t *testing.T) (string, *slurmExecutor) {
+	t.Helper()
+	dir := t.TempDir()
+
+	sbatch := "#!/bin/sh\nprintf '%s\\n' \"$@\" > " + dir + "/sbatch_args\ncat " + dir + "/sbatch_output\n"
+	sacct := "#!/bin/sh\nwhile [ $# -gt 0 ]; do\n\tif [ \"$1\" = \"-j\" ]; then id=$2; fi\n\tshift\ndone\ncat " + dir + "/sacct_$id 2>/dev/null\nexit 0\n"
+	for name, script := range map[string]string{"sbatch": sbatch, "sacct": sacct} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	viper.Set("sbatch_exec", filepath.Join(dir, "sbatch"))
+	viper.Set("sacct_exec", filepath.Join(dir, "sacct"))
+	t.Cleanup(func() {
+		viper.Set("sbatch_exec", "sbatch")
+		viper.Set("sacct_exec", "sacct")
+	})
+	return dir, newSlurmExecutor()
+}
+
+func writeFakeOutput(t *testing.T, dir string, name string, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sbatchArgs(t *testing.T, dir string) []string {
+	t.Helper()
+	content, err := ioutil.ReadFile(filepath.Join(dir, "sbatch_args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func TestSlurmSubmitParsesJobID(t *testing.T) {
+	dir, slurm := fakeSlurm(t)
+
+	for output, expected := range map[string]string{
+		"4242\n":          "4242",
+		"4243;cluster1\n": "4243",
+	} {
+		writeFakeOutput(t, dir, "sbatch_output", output)
+		job_id, err := slurm.Submit(job{Name: "test", Command: []string{"true"}})
+		if err != nil {
+			t.Fatalf("sbatch output %q: %s", output, err)
+		}
+		if job_id != expected {
+			t.Errorf("sbatch output %q gave job ID %s, expected %s", output, job_id, expected)
+		}
+	}
+
+	writeFakeOutput(t, dir, "sbatch_output", "sbatch: error: invalid partition\n")
+	if _, err := slurm.Submit(job{Name: "test", Command: []string{"true"}}); err == nil {
+		t.Error("expected an error for sbatch output without a job ID")
+	}
+}
+
+func TestSlurmSubmitResources(t *testing.T) {
+	dir, slurm := fakeSlurm(t)
+	writeFakeOutput(t, dir, "sbatch_output", "1\n")
+
+	_, err := slurm.Submit(job{
+		Name:     "cell_varcall",
+		Command:  []string{"Rscript", "callVars.R", "cell 1.bam"},
+		Stdout:   "cell.o",
+		Stderr:   "cell.e",
+		Memory:   5000,
+		Cores:    4,
+		Walltime: 90*time.Minute + 10*time.Second,
+		Queue:    "long",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := strings.Join(sbatchArgs(t, dir), " ")
+	for _, expected := range []string{
+		"--parsable", "-J cell_varcall", "-o cell.o", "-e cell.e",
+		"--mem=5000M", "--cpus-per-task=4", "--time=91", "--partition=long",
+		"--wrap Rscript callVars.R 'cell 1.bam'",
+	} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("sbatch arguments %q are missing %q", args, expected)
+		}
+	}
+
+	// resources left at 0 are left to the defaults of SLURM
+	_, err = slurm.Submit(job{Name: "quickcheck", Command: []string{"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args = strings.Join(sbatchArgs(t, dir), " ")
+	for _, unexpected := range []string{"--mem", "--cpus-per-task", "--time", "--partition"} {
+		if strings.Contains(args, unexpected) {
+			t.Errorf("sbatch arguments %q shouldn't have %q", args, unexpected)
+		}
+	}
+}
+
+func TestSlurmStatus(t *testing.T) {
+	dir, slurm := fakeSlurm(t)
+
+	tests := []struct {
+		sacct    string
+		expected jobStatus
+	}{
+		{"", jobStatus{State: jobUnknown}},
+		{"PENDING|0:0", jobStatus{State: jobPending}},
+		{"REQUEUED|0:0", jobStatus{State: jobPending}},
+		{"SUSPENDED|0:0", jobStatus{State: jobPending}},
+		{"RUNNING|0:0", jobStatus{State: jobRunning}},
+		{"COMPLETING|0:0", jobStatus{State: jobRunning}},
+		{"COMPLETED|0:0", jobStatus{State: jobDone}},
+		{"FAILED|3:0", jobStatus{State: jobFailed, Exit_code: 3}},
+		{"FAILED|0:9", jobStatus{State: jobFailed, Exit_code: -1}},
+		{"CANCELLED|0:15", jobStatus{State: jobFailed, Exit_code: -1}},
+		{"CANCELLED by 1234|0:15", jobStatus{State: jobFailed, Exit_code: -1}},
+		{"OUT_OF_MEMORY|0:125", jobStatus{State: jobFailed, Exit_code: -1, Reason: killedMemLimit}},
+		{"TIMEOUT|0:0", jobStatus{State: jobFailed, Exit_code: -1, Reason: killedRunLimit}},
+		{"NODE_FAIL|1:0", jobStatus{State: jobFailed, Exit_code: 1}},
+		{"PREEMPTED|0:0", jobStatus{State: jobFailed, Exit_code: -1}},
+		{"BOOT_FAIL|0:0", jobStatus{State: jobFailed, Exit_code: -1}},
+		{"DEADLINE|0:0", jobStatus{State: jobFailed, Exit_code: -1}},
+		{"SOMETHING_NEW|0:0", jobStatus{State: jobUnknown}},
+	}
+
+	for _, test := range tests {
+		writeFakeOutput(t, dir, "sacct_77", test.sacct+"\n")
+		status, err := slurm.Status("77")
+		if err != nil {
+			t.Fatalf("sacct output %q: %s", test.sacct, err)
+		}
+		if status != test.expected {
+			t.Errorf("sacct output %q gave %+v, expected %+v", test.sacct, status, test.expected)
+		}
+	}
+}
+
+func TestSlurmArray(t *testing.T) {
+	dir, slurm := fakeSlurm(t)
+	writeFakeOutput(t, dir, "sbatch_output", "123\n")
+
+	array_id, err := slurm.SubmitArray(job{
+		Name:    "chunk_0_" + array_index_placeholder,
+		Command: []string{"cellTask.sh", "chunk_0/cells.tsv", array_index_placeholder},
+		Stdout:  "chunk_0/cell_" + array_index_placeholder + ".o",
+		Stderr:  "chunk_0/cell_" + array_index_placeholder + ".e",
+	}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if array_id != "123" {
+		t.Errorf("got array ID %s, expected 123", array_id)
+	}
+
+	args := strings.Join(sbatchArgs(t, dir), " ")
+	for _, expected := range []string{
+		"--array=1-4", "-J chunk_0_", "-o chunk_0/cell_%a.o", "-e chunk_0/cell_%a.e",
+		"--wrap cellTask.sh chunk_0/cells.tsv $SLURM_ARRAY_TASK_ID",
+	} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("sbatch arguments %q are missing %q", args, expected)
+		}
+	}
+
+	task_id := slurm.TaskID(array_id, 4)
+	if task_id != "123_4" {
+		t.Fatalf("got task ID %s, expected 123_4", task_id)
+	}
+
+	writeFakeOutput(t, dir, "sacct_123_4", "OUT_OF_MEMORY|0:125\n")
+	writeFakeOutput(t, dir, "sacct_123_3", "COMPLETED|0:0\n")
+	status, err := slurm.Status(task_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != jobFailed || status.Reason != killedMemLimit {
+		t.Errorf("task 123_4 gave %+v, expected a failure for memory", status)
+	}
+	status, err = slurm.Status(slurm.TaskID(array_id, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != jobDone {
+		t.Errorf("task 123_3 gave %+v, expected it to be done", status)
+	}
+}
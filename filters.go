@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+
+	"scVarCall/bam"
+
+	"github.com/spf13/viper"
+)
+
+// readFilters are what the reads, and their bases, counted by the pileup must
+// pass, set in the read_filters section of the config
+type readFilters struct {
+	Min_base_quality      int
+	Min_mapping_quality   int
+	Required_flags        int
+	Excluded_flags        int
+	Min_distance_from_end int      // bases of the aligned part of the read
+	Max_soft_clip         int      // longest soft clip at either end, -1 for no limit
+	Max_mismatches        int      // NM of the read, -1 for no limit
+	Proper_pair           bool     // only count the reads mapped in a proper pair
+	Excluded_tags         []string `json:",omitempty"` // TAG:VALUE, like RE:I or xf:0
+}
+
+// read_filters are the filters of the config, checked when the pipeline starts
+var read_filters readFilters
+
+// readFiltersFromConfig gives the read filters, checking their values
+func readFiltersFromConfig() (readFilters, error) {
+	filters := readFilters{
+		Min_base_quality:      viper.GetInt("read_filters.min_base_quality"),
+		Min_mapping_quality:   viper.GetInt("read_filters.min_mapping_quality"),
+		Required_flags:        viper.GetInt("read_filters.required_flags"),
+		Excluded_flags:        viper.GetInt("read_filters.excluded_flags"),
+		Min_distance_from_end: viper.GetInt("read_filters.min_distance_from_end"),
+		Max_soft_clip:         viper.GetInt("read_filters.max_soft_clip"),
+		Max_mismatches:        viper.GetInt("read_filters.max_mismatches"),
+		Proper_pair:           viper.GetBool("read_filters.proper_pair"),
+		Excluded_tags:         viper.GetStringSlice("read_filters.excluded_tags"),
+	}
+	if filters.Min_base_quality < 0 || filters.Min_mapping_quality < 0 || filters.Min_distance_from_end < 0 {
+		return filters, fmt.Errorf("min_base_quality, min_mapping_quality and min_distance_from_end should be 0 or more")
+	}
+	if filters.Required_flags < 0 || filters.Required_flags > 0xfff || filters.Excluded_flags < 0 || filters.Excluded_flags > 0xfff {
+		return filters, fmt.Errorf("required_flags and excluded_flags should be SAM flags between 0 and 4095")
+	}
+	if filters.Required_flags&filters.Excluded_flags != 0 {
+		return filters, fmt.Errorf("flags %d are both required and excluded", filters.Required_flags&filters.Excluded_flags)
+	}
+	if filters.Max_soft_clip < -1 || filters.Max_mismatches < -1 {
+		return filters, fmt.Errorf("max_soft_clip and max_mismatches should be -1, for no limit, or more")
+	}
+	for _, excluded_tag := range filters.Excluded_tags {
+		if fields := strings.SplitN(excluded_tag, ":", 2); len(fields) != 2 || len(fields[0]) != 2 {
+			return filters, fmt.Errorf("excluded tag '%s' should be given as TAG:VALUE, like RE:I", excluded_tag)
+		}
+	}
+	return filters, nil
+}
+
+// requiredFlags are the flags of a read the filters need, a proper pair
+// needing its own flag
+func (filters readFilters) requiredFlags() int {
+	if filters.Proper_pair {
+		return filters.Required_flags | bam.FlagProperPair
+	}
+	return filters.Required_flags
+}
+
+// tagValue gives the value of a string or integer tag as a string
+func tagValue(rec *bam.Record, tag string) (string, bool) {
+	if value, found := rec.TagString(tag); found {
+		return value, true
+	}
+	if value, found := rec.TagInt(tag); found {
+		return strconv.Itoa(value), true
+	}
+	return "", false
+}
+
+// keepRead tells whether the bases of a read can be counted
+func (filters readFilters) keepRead(rec *bam.Record) bool {
+	flags := int(rec.Flag)
+	if flags&filters.Excluded_flags != 0 || flags&filters.requiredFlags() != filters.requiredFlags() {
+		return false
+	}
+	if int(rec.Mapq) < filters.Min_mapping_quality {
+		return false
+	}
+	if filters.Max_mismatches >= 0 {
+		if mismatches, found := rec.TagInt("NM"); found && mismatches > filters.Max_mismatches {
+			return false
+		}
+	}
+	if filters.Max_soft_clip >= 0 && len(rec.Cigar) > 0 {
+		for _, op := range []bam.CigarOp{rec.Cigar[0], rec.Cigar[len(rec.Cigar)-1]} {
+			if op.Type() == 'S' && op.Len() > filters.Max_soft_clip {
+				return false
+			}
+		}
+	}
+	for _, excluded_tag := range filters.Excluded_tags {
+		fields := strings.SplitN(excluded_tag, ":", 2)
+		if value, found := tagValue(rec, fields[0]); found && value == fields[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// alignedSpan gives the first and last positions of the read sequence that
+// aren't soft clipped
+func alignedSpan(rec *bam.Record) (int, int) {
+	first, last := 0, len(rec.Seq)-1
+	if len(rec.Cigar) > 0 && rec.Cigar[0].Type() == 'S' {
+		first += rec.Cigar[0].Len()
+	}
+	if len(rec.Cigar) > 1 && rec.Cigar[len(rec.Cigar)-1].Type() == 'S' {
+		last -= rec.Cigar[len(rec.Cigar)-1].Len()
+	}
+	return first, last
+}
+
+// farFromEnds tells whether a position of the read sequence is far enough
+// from the ends of its aligned part
+func (filters readFilters) farFromEnds(query_pos int, first int, last int) bool {
+	return query_pos-first >= filters.Min_distance_from_end && last-query_pos >= filters.Min_distance_from_end
+}
+
+// String gives the active filters in a few words
+func (filters readFilters) String() string {
+	described := []string{
+		fmt.Sprintf("base quality %d", filters.Min_base_quality),
+		fmt.Sprintf("mapping quality %d", filters.Min_mapping_quality),
+		fmt.Sprintf("excluded flags %d", filters.Excluded_flags),
+	}
+	if filters.requiredFlags() != 0 {
+		described = append(described, fmt.Sprintf("required flags %d", filters.requiredFlags()))
+	}
+	if filters.Min_distance_from_end > 0 {
+		described = append(described, fmt.Sprintf("%d bases from read ends", filters.Min_distance_from_end))
+	}
+	if filters.Max_soft_clip >= 0 {
+		described = append(described, fmt.Sprintf("soft clips up to %d", filters.Max_soft_clip))
+	}
+	if filters.Max_mismatches >= 0 {
+		described = append(described, fmt.Sprintf("NM up to %d", filters.Max_mismatches))
+	}
+	if len(filters.Excluded_tags) > 0 {
+		described = append(described, "excluding "+strings.Join(filters.Excluded_tags, " "))
+	}
+	return strings.Join(described, ", ")
+}
+
+// unsupportedByCallVars lists the filters bam2R has no equivalent of, which
+// callVars.R leaves out
+func (filters readFilters) unsupportedByCallVars() []string {
+	var unsupported []string
+	if filters.Min_distance_from_end > 0 {
+		unsupported = append(unsupported, "min_distance_from_end, only applied to the start of reads")
+	}
+	if filters.Max_soft_clip >= 0 {
+		unsupported = append(unsupported, "max_soft_clip")
+	}
+	if len(filters.Excluded_tags) > 0 {
+		unsupported = append(unsupported, "excluded_tags")
+	}
+	return unsupported
+}
+
+// callVarsArgs are the filters given to callVars.R, in the order of its arguments
+func (filters readFilters) callVarsArgs() []string {
+	return []string{
+		strconv.Itoa(filters.Min_base_quality),
+		strconv.Itoa(filters.Min_mapping_quality),
+		strconv.Itoa(filters.Excluded_flags),
+		strconv.Itoa(filters.requiredFlags()),
+		strconv.Itoa(filters.Min_distance_from_end),
+		strconv.Itoa(filters.Max_mismatches),
+	}
+}
+
+// varcallMetadata records how the calls of a run were made
+type varcallMetadata struct {
+	Varcall_engine  string
+	MT_contig       string
+	MT_length       int
+	Reference_fasta string `json:",omitempty"`
+	Read_filters    readFilters
+}
+
+func varcallMetadataPath() string { return output_dir + "/varcall_metadata.json" }
+
+// writeVarcallMetadata writes the settings the calls are made with next to them
+func writeVarcallMetadata(filters readFilters) error {
+	metadata := varcallMetadata{
+		Varcall_engine:  viper.GetString("varcall_engine"),
+		MT_contig:       mt_contig.Name,
+		MT_length:       mt_contig.Length,
+		Reference_fasta: viper.GetString("reference_fasta"),
+		Read_filters:    filters,
+	}
+	metadata_json, _ := json.MarshalIndent(metadata, "", "  ")
+	err := ioutil.WriteFile(varcallMetadataPath(), metadata_json, 0644)
+	if err != nil {
+		return err
+	}
+	log.Println(fmt.Sprintf("Calling variants with %s", filters))
+	return nil
+}
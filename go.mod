@@ -3,7 +3,23 @@ module scVarCall
 go 1.17
 
 require (
-	github.com/google/btree v1.0.0 // indirect
-	github.com/spf13/viper v1.10.0 // indirect
-	github.com/zenthangplus/goccm v0.0.0-20211005163543-2f2e522aca15 // indirect
+	github.com/spf13/viper v1.10.0
+	github.com/zenthangplus/goccm v0.0.0-20211005163543-2f2e522aca15
+)
+
+require (
+	github.com/fsnotify/fsnotify v1.5.1 // indirect
+	github.com/hashicorp/hcl v1.0.0 // indirect
+	github.com/magiconair/properties v1.8.5 // indirect
+	github.com/mitchellh/mapstructure v1.4.3 // indirect
+	github.com/pelletier/go-toml v1.9.4 // indirect
+	github.com/spf13/afero v1.6.0 // indirect
+	github.com/spf13/cast v1.4.1 // indirect
+	github.com/spf13/jwalterweatherman v1.1.0 // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/subosito/gotenv v1.2.0 // indirect
+	golang.org/x/sys v0.0.0-20211205182925-97ca703d548d // indirect
+	golang.org/x/text v0.3.7 // indirect
+	gopkg.in/ini.v1 v1.66.2 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// heteroplasmyModel is how estimateHeteroplasmy.R estimates the heteroplasmy
+// of every call of a cell, with a credible interval and the posterior
+// probability that the variant is in the cell rather than sequencing errors
+type heteroplasmyModel struct {
+	model          string  // binomial, or beta_binomial for reads that aren't independent
+	overdispersion float64 // correlation of the reads of a cell, for beta_binomial
+	prior_alpha    float64 // beta prior of the heteroplasmy, Jeffreys by default
+	prior_beta     float64
+	error_rate     float64 // fraction of reads with the allele from sequencing errors alone
+	prior_present  float64 // prior probability of the variant being in the cell
+	credible_level float64
+	min_coverage   int     // reads at the position for a call to be confident
+	min_posterior  float64 // posterior probability of the variant for a call to be confident
+}
+
+// heteroplasmyModelFromConfig gives the heteroplasmy model, or nil when the
+// heteroplasmy isn't estimated
+func heteroplasmyModelFromConfig() *heteroplasmyModel {
+	if !viper.GetBool("heteroplasmy.enabled") {
+		return nil
+	}
+	return &heteroplasmyModel{
+		model:          viper.GetString("heteroplasmy.model"),
+		overdispersion: viper.GetFloat64("heteroplasmy.overdispersion"),
+		prior_alpha:    viper.GetFloat64("heteroplasmy.prior_alpha"),
+		prior_beta:     viper.GetFloat64("heteroplasmy.prior_beta"),
+		error_rate:     viper.GetFloat64("heteroplasmy.error_rate"),
+		prior_present:  viper.GetFloat64("heteroplasmy.prior_present"),
+		credible_level: viper.GetFloat64("heteroplasmy.credible_level"),
+		min_coverage:   viper.GetInt("heteroplasmy.min_coverage"),
+		min_posterior:  viper.GetFloat64("heteroplasmy.min_posterior"),
+	}
+}
+
+// check returns why the model can't be used, if it can't
+func (model *heteroplasmyModel) check() error {
+	if model.model != "binomial" && model.model != "beta_binomial" {
+		return fmt.Errorf("unknown model '%s', expected binomial or beta_binomial", model.model)
+	}
+	if model.overdispersion < 0 || model.overdispersion >= 1 {
+		return fmt.Errorf("overdispersion should be at least 0 and under 1")
+	}
+	if model.prior_alpha <= 0 || model.prior_beta <= 0 {
+		return fmt.Errorf("prior_alpha and prior_beta should be above 0")
+	}
+	if model.error_rate <= 0 || model.error_rate >= 1 || model.prior_present <= 0 || model.prior_present >= 1 || model.credible_level <= 0 || model.credible_level >= 1 {
+		return fmt.Errorf("error_rate, prior_present and credible_level should be between 0 and 1")
+	}
+	if model.min_coverage < 1 || model.min_posterior < 0 || model.min_posterior > 1 {
+		return fmt.Errorf("min_coverage should be at least 1 and min_posterior between 0 and 1")
+	}
+	return nil
+}
+
+func heteroplasmyOutput(dir string) string { return dir + "heteroplasmy/" }
+
+// heteroplasmyPath has a line for every variant called in every cell
+func heteroplasmyPath(dir string) string { return heteroplasmyOutput(dir) + "heteroplasmy.tsv.gz" }
+
+func heteroplasmyJob(calls []string, coverage []string, dir string, model *heteroplasmyModel) job {
+	float := func(value float64) string { return strconv.FormatFloat(value, 'g', -1, 64) }
+	return withResources("heteroplasmy", job{
+		Name:   "heteroplasmy",
+		Stdout: heteroplasmyOutput(dir) + "heteroplasmy.o",
+		Stderr: heteroplasmyOutput(dir) + "heteroplasmy.e",
+		Command: []string{
+			Rscript_exec, "estimateHeteroplasmy.R",
+			strings.Join(calls, ","), strings.Join(coverage, ","), heteroplasmyPath(dir),
+			model.model, float(model.overdispersion), float(model.prior_alpha), float(model.prior_beta),
+			float(model.error_rate), float(model.prior_present), float(model.credible_level),
+			strconv.Itoa(model.min_coverage), float(model.min_posterior)},
+	})
+}
+
+// estimateCellHeteroplasmy estimates the heteroplasmy of every call of the
+// given cells into dir, recording it on owner
+func estimateCellHeteroplasmy(cells []barcode, dir string, owner *barcode) error {
+	model := heteroplasmyModelFromConfig()
+	if model == nil {
+		log.Println("Heteroplasmy estimation is disabled, skipping it")
+		return nil
+	}
+	calls, coverage := cellRdsPaths(cells)
+	if len(calls) == 0 {
+		log.Println("No cell has calls to estimate the heteroplasmy of")
+		return nil
+	}
+
+	err := os.MkdirAll(heteroplasmyOutput(dir), 0755)
+	if err != nil {
+		return err
+	}
+	log.Println(fmt.Sprintf("Estimating the heteroplasmy of every call with a %s model", model.model))
+	err = runJob(heteroplasmyJob(calls, coverage, dir, model), owner)
+	if err != nil {
+		return err
+	}
+	owner.Heteroplasmy_estimates = heteroplasmyPath(dir)
+	return nil
+}
+
+// step 10
+func estimateHeteroplasmy() error {
+	return estimateCellHeteroplasmy(barcode_list[1:], output_dir, &barcode_list[0])
+}
+
+func planEstimateHeteroplasmy(step *plannedStep) {
+	model := heteroplasmyModelFromConfig()
+	if model == nil {
+		step.Notes = append(step.Notes, "heteroplasmy is disabled, nothing is run")
+		return
+	}
+	calls, coverage := plannedCellRdsPaths(step)
+	planHeteroplasmy(step, calls, coverage, output_dir, model)
+}
+
+func planHeteroplasmy(step *plannedStep, calls []string, coverage []string, dir string, model *heteroplasmyModel) {
+	step.Created = append(step.Created, heteroplasmyOutput(dir))
+	step.Jobs = append(step.Jobs,
+		planJob(heteroplasmyJob(calls, coverage, dir, model), append(append([]string{}, calls...), coverage...), []string{heteroplasmyPath(dir)}),
+	)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// errInterrupted is returned by the steps when the pipeline was interrupted
+// while they were waiting on jobs, which were cancelled
+var errInterrupted = errors.New("pipeline was interrupted")
+
+// interrupted is closed once SIGINT or SIGTERM is received
+var interrupted = make(chan struct{})
+
+// handleInterrupts makes the first SIGINT or SIGTERM stop the pipeline
+// gracefully, a second one exits straight away
+func handleInterrupts() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		log.Println(fmt.Sprintf("Received %s, cancelling outstanding jobs and saving progress, send it again to exit now", sig))
+		close(interrupted)
+
+		sig = <-signals
+		log.Println(fmt.Sprintf("Received %s again, exiting without saving progress", sig))
+		os.Exit(1)
+	}()
+}
+
+func wasInterrupted() bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// a partial checkpoint holds the progress of a step that was interrupted, so
+// the next run picks the step up where it was left
+func partialCheckpointPath(step int) string {
+	return output_dir + fmt.Sprintf("checkpoint_%d.partial.json", step)
+}
+
+func writePartialCheckpoint(barcode_list []barcode, step int) {
+	partialJson, _ := json.MarshalIndent(barcode_list, "", "  ")
+	err := ioutil.WriteFile(partialCheckpointPath(step), partialJson, 0644)
+	if err != nil {
+		panic(err)
+	}
+	log.Println(fmt.Sprintf("Partial checkpoint saved for step %d", step))
+}
+
+// loadPartialCheckpoint loads barcode_list from the partial checkpoint of a
+// step, returning false if the step wasn't interrupted
+func loadPartialCheckpoint(step int) bool {
+	if !fileExists(partialCheckpointPath(step)) {
+		return false
+	}
+
+	partialJson, err := ioutil.ReadFile(partialCheckpointPath(step))
+	if err != nil {
+		panic(err)
+	}
+	barcode_list = nil
+	err = json.Unmarshal(partialJson, &barcode_list)
+	if err != nil {
+		panic(err)
+	}
+
+	log.Println(fmt.Sprintf("Partial checkpoint exists for step %d, resuming from it", step))
+	return true
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// the job was still pending or running when its timeout was reached
+	jobTimedOut jobState = "TIMEOUT"
+	// the scheduler stopped knowing about the job before it finished
+	jobLost jobState = "LOST"
+	// the job was cancelled because the pipeline was interrupted
+	jobCancelled jobState = "CANCELLED"
+)
+
+// jobRecord is kept on the barcode for every job run on its behalf, so the
+// checkpoint tells which jobs failed, how, and what was retried
+type jobRecord struct {
+	Job_id            string
+	Command           string
+	State             jobState
+	Exit_code         int
+	Reason            string `json:",omitempty"`
+	Attempt           int
+	Memory            int
+	Walltime          string `json:",omitempty"`
+	Submitted_at      time.Time
+	Finished_at       time.Time
+	Previous_attempts []jobRecord `json:",omitempty"`
+}
+
+func (cell *barcode) recordJob(step string, record jobRecord) {
+	if cell.Jobs == nil {
+		cell.Jobs = make(map[string]jobRecord)
+	}
+	cell.Jobs[step] = record
+}
+
+type trackedJob struct {
+	spec      job
+	record    jobRecord
+	history   []jobRecord
+	last_seen time.Time // last time the executor knew what state the job was in
+}
+
+// queuedJob is a job waiting to be (re)submitted once submit_at has passed
+type queuedJob struct {
+	spec      job
+	history   []jobRecord
+	submit_at time.Time
+}
+
+// jobTracker submits jobs and follows them until they finish, giving up on
+// those running past their timeout or that the executor lost track of, and
+// resubmitting failed ones up to max_retries times
+type jobTracker struct {
+	job_timeout  time.Duration
+	lost_timeout time.Duration
+
+	max_retries     int
+	retry_backoff   time.Duration
+	memory_factor   float64
+	walltime_factor float64
+
+	jobs   map[string]*trackedJob
+	queued map[string]*queuedJob
+}
+
+// pipeline_deadline is when the global timeout runs out, all jobs still
+// outstanding at that point are cancelled
+var pipeline_deadline time.Time
+
+// newJobTracker returns a tracker that doesn't retry failed jobs, see
+// newRetryingJobTracker for one that does
+func newJobTracker() *jobTracker {
+	return &jobTracker{
+		job_timeout:  viper.GetDuration("job_timeout"),
+		lost_timeout: viper.GetDuration("lost_job_timeout"),
+		jobs:         make(map[string]*trackedJob),
+		queued:       make(map[string]*queuedJob),
+	}
+}
+
+// newRetryingJobTracker returns a tracker following the "retry" section of the
+// config, used for the per-cell jobs where a single failure shouldn't lose the cell
+func newRetryingJobTracker() *jobTracker {
+	tracker := newJobTracker()
+	tracker.max_retries = viper.GetInt("retry.max_retries")
+	tracker.retry_backoff = viper.GetDuration("retry.backoff")
+	tracker.memory_factor = viper.GetFloat64("retry.memory_factor")
+	tracker.walltime_factor = viper.GetFloat64("retry.walltime_factor")
+	return tracker
+}
+
+// enqueue adds a job to be submitted on the next pass of waitAll under the given key
+func (tracker *jobTracker) enqueue(key string, j job) {
+	tracker.queued[key] = &queuedJob{spec: j, submit_at: time.Now()}
+}
+
+// track follows a job that was already submitted, like a task of a job array,
+// the spec being what gets resubmitted if it needs to be retried
+func (tracker *jobTracker) track(key string, job_id string, spec job) {
+	now := time.Now()
+	tracked := &trackedJob{
+		spec:      spec,
+		last_seen: now,
+		record: jobRecord{
+			Job_id:       job_id,
+			Command:      commandLine(spec),
+			State:        jobPending,
+			Attempt:      1,
+			Memory:       spec.Memory,
+			Submitted_at: now,
+		},
+	}
+	if spec.Walltime > 0 {
+		tracked.record.Walltime = spec.Walltime.String()
+	}
+	tracker.jobs[key] = tracked
+}
+
+// submitQueued sends every queued job whose time has come to the executor,
+// returning the keys of those that failed to submit and won't be retried
+func (tracker *jobTracker) submitQueued() []string {
+	var abandoned []string
+	now := time.Now()
+
+	for key, queued := range tracker.queued {
+		if now.Before(queued.submit_at) {
+			continue
+		}
+		delete(tracker.queued, key)
+
+		tracked := &trackedJob{
+			spec:      queued.spec,
+			history:   queued.history,
+			last_seen: now,
+			record: jobRecord{
+				Command:      commandLine(queued.spec),
+				State:        jobPending,
+				Attempt:      len(queued.history) + 1,
+				Memory:       queued.spec.Memory,
+				Submitted_at: now,
+			},
+		}
+		if queued.spec.Walltime > 0 {
+			tracked.record.Walltime = queued.spec.Walltime.String()
+		}
+		tracker.jobs[key] = tracked
+
+		job_id, err := job_executor.Submit(queued.spec)
+		if err != nil {
+			log.Println(fmt.Sprintf("Unable to submit job %s: %s", queued.spec.Name, err))
+			tracked.record.State = jobFailed
+			tracked.record.Exit_code = -1
+			tracked.record.Finished_at = now
+			if tracker.retry(key, tracked) {
+				delete(tracker.jobs, key)
+			} else {
+				abandoned = append(abandoned, key)
+			}
+			continue
+		}
+		tracked.record.Job_id = job_id
+	}
+	return abandoned
+}
+
+// check asks the executor about a job and returns whether it should no longer be waited on
+func (tracker *jobTracker) check(tracked *trackedJob) bool {
+	now := time.Now()
+	record := &tracked.record
+
+	status, err := job_executor.Status(record.Job_id)
+	if err != nil {
+		log.Println(fmt.Sprintf("Unable to get status of job %s: %s", record.Job_id, err))
+		status = jobStatus{State: jobUnknown}
+	}
+
+	switch {
+	case status.finished():
+		record.State = status.State
+		record.Exit_code = status.Exit_code
+		record.Reason = status.Reason
+	case status.State == jobUnknown:
+		if tracker.lost_timeout > 0 && now.Sub(tracked.last_seen) > tracker.lost_timeout {
+			record.State = jobLost
+			record.Exit_code = -1
+		}
+	default:
+		record.State = status.State
+		tracked.last_seen = now
+	}
+
+	if record.State == jobPending || record.State == jobRunning {
+		job_expired := tracker.job_timeout > 0 && now.Sub(record.Submitted_at) > tracker.job_timeout
+		pipeline_expired := !pipeline_deadline.IsZero() && now.After(pipeline_deadline)
+		if job_expired || pipeline_expired {
+			record.State = jobTimedOut
+			record.Exit_code = -1
+		}
+	}
+
+	switch record.State {
+	case jobPending, jobRunning:
+		return false
+	case jobTimedOut, jobLost:
+		// make sure it doesn't keep using resources behind our back
+		if err := job_executor.Cancel(record.Job_id); err != nil {
+			log.Println(fmt.Sprintf("Unable to cancel job %s: %s", record.Job_id, err))
+		}
+	}
+
+	record.Finished_at = now
+	return true
+}
+
+// retry queues a failed job to be submitted again after a backoff doubling
+// with every attempt, asking for more memory or time if that is what it was
+// killed for. Returns false when the job has no retries left.
+func (tracker *jobTracker) retry(key string, tracked *trackedJob) bool {
+	record := tracked.record
+	if record.State != jobFailed && record.State != jobLost {
+		return false
+	}
+	if len(tracked.history) >= tracker.max_retries {
+		return false
+	}
+	if !pipeline_deadline.IsZero() && time.Now().After(pipeline_deadline) {
+		return false
+	}
+
+	backoff := tracker.retry_backoff * time.Duration(1<<uint(len(tracked.history)))
+	log.Println(fmt.Sprintf("Job %s for %s ended with %s, retry %d of %d in %s",
+		record.Job_id, key, record.State, len(tracked.history)+1, tracker.max_retries, backoff))
+
+	spec := tracked.spec
+	switch record.Reason {
+	case killedMemLimit:
+		if spec.Memory > 0 && tracker.memory_factor > 1 {
+			spec.Memory = int(math.Ceil(float64(spec.Memory) * tracker.memory_factor))
+			log.Println(fmt.Sprintf("Job %s was killed for using too much memory, asking for %d MB", record.Job_id, spec.Memory))
+		}
+	case killedRunLimit:
+		if spec.Walltime > 0 && tracker.walltime_factor > 1 {
+			spec.Walltime = time.Duration(float64(spec.Walltime) * tracker.walltime_factor)
+			log.Println(fmt.Sprintf("Job %s was killed for running too long, asking for %s", record.Job_id, spec.Walltime))
+		}
+	}
+
+	tracker.queued[key] = &queuedJob{
+		spec:      spec,
+		history:   append(tracked.history, record),
+		submit_at: time.Now().Add(backoff),
+	}
+	return true
+}
+
+// waitAll submits the queued jobs and polls every tracked job until none are
+// left, calling on_finished with the final record of each job as soon as it
+// is done with. Failed jobs are retried first when the tracker allows it.
+// If the pipeline is interrupted every outstanding job is cancelled and
+// errInterrupted is returned.
+func (tracker *jobTracker) waitAll(on_finished func(key string, record jobRecord)) error {
+	for len(tracker.jobs) > 0 || len(tracker.queued) > 0 {
+		if wasInterrupted() {
+			tracker.cancelAll(on_finished)
+			return errInterrupted
+		}
+
+		for _, key := range tracker.submitQueued() {
+			tracker.finish(key, on_finished)
+		}
+
+		for key, tracked := range tracker.jobs {
+			if tracked.record.Job_id == "" || !tracker.check(tracked) {
+				continue
+			}
+			if tracked.record.State != jobDone && tracker.retry(key, tracked) {
+				delete(tracker.jobs, key)
+				continue
+			}
+			tracker.finish(key, on_finished)
+		}
+
+		// sleep after going through every job's status before retrying
+		if len(tracker.jobs) > 0 || len(tracker.queued) > 0 {
+			select {
+			case <-interrupted:
+			case <-time.After(job_poll_interval):
+			}
+		}
+	}
+	return nil
+}
+
+// cancelAll cancels every job that is still outstanding, including those
+// waiting to be submitted, and finishes them as cancelled
+func (tracker *jobTracker) cancelAll(on_finished func(key string, record jobRecord)) {
+	now := time.Now()
+	cancelled := 0
+
+	for key, queued := range tracker.queued {
+		delete(tracker.queued, key)
+		tracker.jobs[key] = &trackedJob{
+			spec:    queued.spec,
+			history: queued.history,
+			record: jobRecord{
+				Command: commandLine(queued.spec),
+				Attempt: len(queued.history) + 1,
+				Memory:  queued.spec.Memory,
+			},
+		}
+	}
+
+	for key, tracked := range tracker.jobs {
+		if tracked.record.Job_id != "" {
+			if err := job_executor.Cancel(tracked.record.Job_id); err != nil {
+				log.Println(fmt.Sprintf("Unable to cancel job %s: %s", tracked.record.Job_id, err))
+			}
+		}
+		tracked.record.State = jobCancelled
+		tracked.record.Exit_code = -1
+		tracked.record.Finished_at = now
+		tracker.finish(key, on_finished)
+		cancelled++
+	}
+
+	if cancelled > 0 {
+		log.Println(fmt.Sprintf("Cancelled %d outstanding jobs", cancelled))
+	}
+}
+
+func (tracker *jobTracker) finish(key string, on_finished func(key string, record jobRecord)) {
+	tracked := tracker.jobs[key]
+	delete(tracker.jobs, key)
+
+	record := tracked.record
+	record.Previous_attempts = tracked.history
+	on_finished(key, record)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeExecutor finishes every attempt of a job with the next status given for
+// its name, and keeps the spec of every submission to check what was retried
+type fakeExecutor struct {
+	mu        sync.Mutex
+	outcomes  map[string][]jobStatus
+	submitted []job
+	jobs      map[string]jobStatus
+	cancelled []string
+}
+
+func newFakeExecutor(outcomes map[string][]jobStatus) *fakeExecutor {
+	return &fakeExecutor{outcomes: outcomes, jobs: make(map[string]jobStatus)}
+}
+
+func (fake *fakeExecutor) Submit(j job) (string, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	job_id := "fake_" + strconv.Itoa(len(fake.submitted)+1)
+	fake.submitted = append(fake.submitted, j)
+	status := jobStatus{State: jobDone}
+	if outcomes := fake.outcomes[j.Name]; len(outcomes) > 0 {
+		status = outcomes[0]
+		fake.outcomes[j.Name] = outcomes[1:]
+	}
+	fake.jobs[job_id] = status
+	return job_id, nil
+}
+
+func (fake *fakeExecutor) Status(job_id string) (jobStatus, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.jobs[job_id], nil
+}
+
+func (fake *fakeExecutor) Wait(job_id string) (jobStatus, error) {
+	return pollUntilFinished(job_id, fake.Status)
+}
+
+func (fake *fakeExecutor) Cancel(job_id string) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.cancelled = append(fake.cancelled, job_id)
+	return nil
+}
+
+// useFakeExecutor makes the tracker submit to a fake executor without waiting between polls
+func useFakeExecutor(t *testing.T, outcomes map[string][]jobStatus) *fakeExecutor {
+	t.Helper()
+	fake := newFakeExecutor(outcomes)
+	previous_executor, previous_interval := job_executor, job_poll_interval
+	job_executor, job_poll_interval = fake, time.Millisecond
+	t.Cleanup(func() {
+		job_executor, job_poll_interval = previous_executor, previous_interval
+	})
+	return fake
+}
+
+func testTracker(max_retries int) *jobTracker {
+	return &jobTracker{
+		lost_timeout:    time.Nanosecond,
+		max_retries:     max_retries,
+		memory_factor:   2,
+		walltime_factor: 2,
+		jobs:            make(map[string]*trackedJob),
+		queued:          make(map[string]*queuedJob),
+	}
+}
+
+func runTracker(t *testing.T, tracker *jobTracker, jobs ...job) map[string]jobRecord {
+	t.Helper()
+	for _, j := range jobs {
+		tracker.enqueue(j.Name, j)
+	}
+	records := make(map[string]jobRecord)
+	err := tracker.waitAll(func(key string, record jobRecord) {
+		records[key] = record
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestTrackerRetriesFailedJob(t *testing.T) {
+	fake := useFakeExecutor(t, map[string][]jobStatus{
+		"cell_1": {{State: jobFailed, Exit_code: 1}, {State: jobDone}},
+	})
+
+	spec := job{Name: "cell_1", Command: []string{"true"}, Memory: 1000, Walltime: time.Hour}
+	record := runTracker(t, testTracker(2), spec)["cell_1"]
+
+	if record.State != jobDone || record.Attempt != 2 {
+		t.Errorf("got state %s on attempt %d, expected DONE on attempt 2", record.State, record.Attempt)
+	}
+	if len(record.Previous_attempts) != 1 || record.Previous_attempts[0].State != jobFailed || record.Previous_attempts[0].Exit_code != 1 {
+		t.Errorf("expected the failed attempt to be kept, got %+v", record.Previous_attempts)
+	}
+	// a plain failure is retried with the same resources
+	if retried := fake.submitted[1]; retried.Memory != 1000 || retried.Walltime != time.Hour {
+		t.Errorf("retry asked for %d MB and %s, expected the same as the first attempt", retried.Memory, retried.Walltime)
+	}
+}
+
+func TestTrackerGivesUpAfterMaxRetries(t *testing.T) {
+	fake := useFakeExecutor(t, map[string][]jobStatus{
+		"cell_1": {{State: jobFailed, Exit_code: 1}, {State: jobFailed, Exit_code: 2}, {State: jobFailed, Exit_code: 3}},
+	})
+
+	record := runTracker(t, testTracker(1), job{Name: "cell_1", Command: []string{"true"}})["cell_1"]
+
+	if record.State != jobFailed || record.Exit_code != 2 || record.Attempt != 2 {
+		t.Errorf("got %s with exit code %d on attempt %d, expected the second failure", record.State, record.Exit_code, record.Attempt)
+	}
+	if len(fake.submitted) != 2 {
+		t.Errorf("job was submitted %d times, expected 2", len(fake.submitted))
+	}
+}
+
+func TestTrackerRetriesLostJob(t *testing.T) {
+	fake := useFakeExecutor(t, map[string][]jobStatus{
+		"cell_1": {{State: jobUnknown}, {State: jobDone}},
+	})
+
+	record := runTracker(t, testTracker(2), job{Name: "cell_1", Command: []string{"true"}})["cell_1"]
+
+	if record.State != jobDone || len(record.Previous_attempts) != 1 || record.Previous_attempts[0].State != jobLost {
+		t.Errorf("expected a LOST attempt then a DONE one, got %s after %+v", record.State, record.Previous_attempts)
+	}
+	if len(fake.cancelled) != 1 || fake.cancelled[0] != record.Previous_attempts[0].Job_id {
+		t.Errorf("expected the lost job to be cancelled, cancelled %v", fake.cancelled)
+	}
+}
+
+func TestTrackerEscalatesMemory(t *testing.T) {
+	fake := useFakeExecutor(t, map[string][]jobStatus{
+		"cell_1": {{State: jobFailed, Exit_code: -1, Reason: killedMemLimit}, {State: jobDone}},
+	})
+
+	spec := job{Name: "cell_1", Command: []string{"true"}, Memory: 5000, Walltime: time.Hour}
+	record := runTracker(t, testTracker(2), spec)["cell_1"]
+
+	if record.State != jobDone || record.Memory != 10000 {
+		t.Errorf("got %s with %d MB, expected DONE with 10000 MB", record.State, record.Memory)
+	}
+	if fake.submitted[1].Walltime != time.Hour {
+		t.Errorf("walltime changed to %s on a memory retry", fake.submitted[1].Walltime)
+	}
+}
+
+func TestTrackerEscalatesWalltime(t *testing.T) {
+	fake := useFakeExecutor(t, map[string][]jobStatus{
+		"cell_1": {
+			{State: jobFailed, Exit_code: -1, Reason: killedRunLimit},
+			{State: jobFailed, Exit_code: -1, Reason: killedRunLimit},
+			{State: jobDone},
+		},
+	})
+
+	spec := withResources("cell_varcall", job{Name: "cell_1", Command: []string{"true"}})
+	if spec.Walltime == 0 {
+		t.Fatal("cell_varcall has no default walltime to escalate from")
+	}
+	record := runTracker(t, testTracker(2), spec)["cell_1"]
+
+	if record.State != jobDone || record.Walltime != (4*spec.Walltime).String() {
+		t.Errorf("got %s with walltime %s, expected DONE with %s", record.State, record.Walltime, 4*spec.Walltime)
+	}
+	if fake.submitted[1].Walltime != 2*spec.Walltime || fake.submitted[1].Memory != spec.Memory {
+		t.Errorf("first retry asked for %d MB and %s, expected %d MB and %s",
+			fake.submitted[1].Memory, fake.submitted[1].Walltime, spec.Memory, 2*spec.Walltime)
+	}
+}
+
+func TestTrackerWithoutRetries(t *testing.T) {
+	fake := useFakeExecutor(t, map[string][]jobStatus{
+		"merge": {{State: jobFailed, Exit_code: 1}},
+	})
+
+	records := runTracker(t, testTracker(0), job{Name: "merge", Command: []string{"true"}}, job{Name: "other", Command: []string{"true"}})
+
+	if records["merge"].State != jobFailed || records["other"].State != jobDone {
+		t.Errorf("got merge %s and other %s, expected FAILED and DONE", records["merge"].State, records["other"].State)
+	}
+	if len(fake.submitted) != 2 {
+		t.Errorf("expected a single submission of each job, got %d", len(fake.submitted))
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"scVarCall/bam"
+
+	"github.com/spf13/viper"
+)
+
+// nativeTask is work done by the pipeline itself with the bam package instead
+// of an external tool, the description standing in for its command line
+type nativeTask struct {
+	Description string
+	run         func() error
+}
+
+// useNativeBam tells whether the master bam steps are done in process rather
+// than with samtools jobs
+func useNativeBam() bool {
+	return viper.GetString("bam_engine") == "native"
+}
+
+// runNative runs the task of a job in process, recording it on the owner like
+// a submitted job
+func runNative(j job, owner *barcode) error {
+	log.Println(fmt.Sprintf("Running %s in process", j.Name))
+
+	record := jobRecord{
+		Job_id:       "native",
+		Command:      j.Native.Description,
+		State:        jobDone,
+		Attempt:      1,
+		Submitted_at: time.Now(),
+	}
+	err := j.Native.run()
+	record.Finished_at = time.Now()
+	if err != nil {
+		record.State = jobFailed
+		record.Exit_code = 1
+	}
+	owner.recordJob(j.Name, record)
+
+	if err != nil {
+		return fmt.Errorf("%s failed: %w", j.Name, err)
+	}
+	return nil
+}
+
+func nativeQuickcheckJob(bam_filename string) job {
+	return job{
+		Name: "quickcheck_" + filepath.Base(bam_filename),
+		Native: &nativeTask{
+			Description: "check " + bam_filename + " is a complete BAM file",
+			run: func() error {
+				return bam.Quickcheck(bam_filename)
+			},
+		},
+	}
+}
+
+func nativeIndexJob(bam_filename string) job {
+	return job{
+		Name: "index_" + filepath.Base(bam_filename),
+		Native: &nativeTask{
+			Description: "write the BAI index of " + bam_filename,
+			run: func() error {
+				return bam.IndexFile(bam_filename)
+			},
+		},
+	}
+}
+
+func nativeMTSubsetJob(input string, mt_subset_bam string) job {
+	return job{
+		Name: "MT_subset",
+		Native: &nativeTask{
+			Description: "write the " + mt_contig.Name + " reads of " + input + " to " + mt_subset_bam + " along with its index",
+			run: func() error {
+				reads, err := bam.ExtractContig(input, mt_subset_bam, mt_contig.Name)
+				if err == nil {
+					log.Println(fmt.Sprintf("Wrote %d %s reads to %s", reads, mt_contig.Name, mt_subset_bam))
+				}
+				return err
+			},
+		},
+	}
+}
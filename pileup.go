@@ -0,0 +1,733 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"scVarCall/bam"
+
+	"github.com/spf13/viper"
+)
+
+// pileup_bases are counted in the order of the columns used by callVars.R
+const pileup_bases = "ATCG"
+
+// strands of the reads, in the order of the counts of an allele
+const (
+	strand_fwd = iota
+	strand_rev
+)
+
+// pileupCounts are the reads of each allele seen at a position on each
+// strand: the bases as "alt<B>", the deletions starting at the position as
+// "del<length>" and the insertions after it as "ins<sequence>"
+type pileupCounts struct {
+	alleles map[string]*[2]int
+	deleted [2]int // reads with a deletion over the position, which count in its coverage
+}
+
+func newPileupCounts() *pileupCounts {
+	return &pileupCounts{alleles: make(map[string]*[2]int)}
+}
+
+func (counts *pileupCounts) add(allele string, strand int, reads int) {
+	allele_counts, found := counts.alleles[allele]
+	if !found {
+		allele_counts = &[2]int{}
+		counts.alleles[allele] = allele_counts
+	}
+	allele_counts[strand] += reads
+}
+
+// strandCount is the count of an allele on a strand
+func (counts *pileupCounts) strandCount(allele string, strand int) int {
+	if allele_counts, found := counts.alleles[allele]; found {
+		return allele_counts[strand]
+	}
+	return 0
+}
+
+// total is the count of an allele on both strands
+func (counts *pileupCounts) total(allele string) int {
+	return counts.strandCount(allele, strand_fwd) + counts.strandCount(allele, strand_rev)
+}
+
+// strandCoverage is the reads of a strand with a base at the position or
+// spanning it with a deletion
+func (counts *pileupCounts) strandCoverage(strand int) int {
+	coverage := counts.deleted[strand]
+	for _, base := range pileup_bases {
+		coverage += counts.strandCount("alt"+string(base), strand)
+	}
+	return coverage
+}
+
+func (counts *pileupCounts) coverage() int {
+	return counts.strandCoverage(strand_fwd) + counts.strandCoverage(strand_rev)
+}
+
+// names gives the alleles seen, the bases first in the order of pileup_bases
+// then the indels in alphabetical order
+func (counts *pileupCounts) names() []string {
+	var names []string
+	for _, base := range pileup_bases {
+		if counts.total("alt"+string(base)) > 0 {
+			names = append(names, "alt"+string(base))
+		}
+	}
+	var indels []string
+	for allele := range counts.alleles {
+		if !strings.HasPrefix(allele, "alt") && counts.total(allele) > 0 {
+			indels = append(indels, allele)
+		}
+	}
+	sort.Strings(indels)
+	return append(names, indels...)
+}
+
+// consensusOptions are what the reads sharing a UMI must agree on for their
+// consensus base to be counted
+type consensusOptions struct {
+	min_family_size int     // reads of the UMI with a base at the position
+	min_agreement   float64 // fraction of those reads with the consensus base
+}
+
+// consensusFromConfig gives the consensus options, or nil when every read is
+// counted on its own
+func consensusFromConfig() *consensusOptions {
+	if !viper.GetBool("consensus.enabled") {
+		return nil
+	}
+	return &consensusOptions{
+		min_family_size: viper.GetInt("consensus.min_family_size"),
+		min_agreement:   viper.GetFloat64("consensus.min_agreement"),
+	}
+}
+
+// strandFilter leaves out of the calls the variants whose counts on the
+// forward and reverse strands don't agree across cells, as strand specific
+// artefacts do
+type strandFilter struct {
+	min_correlation float64 // of the forward and reverse counts across cells
+	min_cells       int     // cells with the variant needed to filter on it
+}
+
+// strandFilterFromConfig gives the strand filter, or nil when every variant is kept
+func strandFilterFromConfig() *strandFilter {
+	if !viper.GetBool("strand_filter.enabled") {
+		return nil
+	}
+	return &strandFilter{
+		min_correlation: viper.GetFloat64("strand_filter.min_correlation"),
+		min_cells:       viper.GetInt("strand_filter.min_cells"),
+	}
+}
+
+// strandCorrelation is the Pearson correlation of the forward and reverse
+// counts of a variant across cells, like the strand correlation of mgatk.
+// It is undefined with less than 2 cells or when either count doesn't vary.
+func strandCorrelation(fwd []float64, rev []float64) (float64, bool) {
+	n := float64(len(fwd))
+	if len(fwd) < 2 {
+		return 0, false
+	}
+	var sum_fwd, sum_rev float64
+	for i := range fwd {
+		sum_fwd += fwd[i]
+		sum_rev += rev[i]
+	}
+	mean_fwd, mean_rev := sum_fwd/n, sum_rev/n
+	var covariance, var_fwd, var_rev float64
+	for i := range fwd {
+		covariance += (fwd[i] - mean_fwd) * (rev[i] - mean_rev)
+		var_fwd += (fwd[i] - mean_fwd) * (fwd[i] - mean_fwd)
+		var_rev += (rev[i] - mean_rev) * (rev[i] - mean_rev)
+	}
+	if var_fwd == 0 || var_rev == 0 {
+		return 0, false
+	}
+	return covariance / math.Sqrt(var_fwd*var_rev), true
+}
+
+// pileupFamily are the reads of a cell sharing a UMI, or all the reads of the
+// cell without consensus
+type pileupFamily struct {
+	label string
+	umi   string
+}
+
+// pileupSummary is what the pileup found about the cells, by label
+type pileupSummary struct {
+	covered         map[string]bool        // cells with any coverage
+	family_sizes    map[string]map[int]int // number of UMIs with each number of reads, with consensus
+	strand_filtered int                    // variants left out by the strand filter
+}
+
+// pileupEngine counts the bases seen at every position for every cell while
+// streaming once through a coordinate sorted bam, keyed by the CB tag of the
+// reads. Only a window of positions is kept in memory: once the reads start
+// past a position no later read can cover it, so its counts are written out.
+// With consensus the bases are first counted for every UMI of the cell, each
+// UMI then counting once for the base its reads agree on.
+type pileupEngine struct {
+	ref_id    int
+	labels    map[string]string // CB tag to the label of the cell
+	filters   readFilters
+	consensus *consensusOptions
+	strand    *strandFilter
+	reference []byte // MT sequence the reference base of every position is taken from
+	window    map[int]map[pileupFamily]*pileupCounts
+	umi_reads map[pileupFamily]int
+
+	calls           *tableWriter
+	coverage        *tableWriter
+	variant_stats   *tableWriter
+	covered         map[string]bool
+	strand_filtered int
+}
+
+// tableWriter writes a gzipped tab separated table
+type tableWriter struct {
+	file *os.File
+	gz   *gzip.Writer
+	buf  *bufio.Writer
+}
+
+func newTableWriter(path string, columns ...string) (*tableWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(file)
+	table := &tableWriter{file: file, gz: gz, buf: bufio.NewWriter(gz)}
+	table.row(columns...)
+	return table, nil
+}
+
+func (table *tableWriter) row(fields ...string) {
+	table.buf.WriteString(strings.Join(fields, "\t"))
+	table.buf.WriteByte('\n')
+}
+
+func (table *tableWriter) Close() error {
+	err := table.buf.Flush()
+	if gz_err := table.gz.Close(); err == nil {
+		err = gz_err
+	}
+	if file_err := table.file.Close(); err == nil {
+		err = file_err
+	}
+	return err
+}
+
+// add counts the bases of a read that pass the read filters, on the strand
+// of the read
+func (engine *pileupEngine) add(rec *bam.Record) {
+	if rec.Ref_id != engine.ref_id || !engine.filters.keepRead(rec) {
+		return
+	}
+	cell_barcode, found := rec.TagString("CB")
+	if !found {
+		return
+	}
+	label, found := engine.labels[cell_barcode]
+	if !found {
+		return
+	}
+	strand := strand_fwd
+	if rec.Flag&bam.FlagReverse != 0 {
+		strand = strand_rev
+	}
+	family := pileupFamily{label: label}
+	if engine.consensus != nil {
+		family.umi, found = rec.TagString("UB")
+		if !found {
+			return
+		}
+		engine.umi_reads[family]++
+	}
+
+	first, last := alignedSpan(rec)
+	ref_pos := rec.Pos
+	query_pos := 0
+	aligned := false // whether a base of the read was aligned before an insertion, to anchor it
+	for _, op := range rec.Cigar {
+		switch op.Type() {
+		case 'M', '=', 'X':
+			for i := 0; i < op.Len(); i++ {
+				if engine.filters.farFromEnds(query_pos+i, first, last) {
+					engine.countBase(family, ref_pos+i, strand, rec.Seq[query_pos+i], rec.Qual[query_pos+i])
+				}
+			}
+			ref_pos += op.Len()
+			query_pos += op.Len()
+			aligned = aligned || op.Len() > 0
+		case 'I':
+			if aligned && engine.filters.farFromEnds(query_pos, first, last) {
+				engine.countInsertion(family, ref_pos-1, strand, rec.Seq[query_pos:query_pos+op.Len()], rec.Qual[query_pos:query_pos+op.Len()])
+			}
+			query_pos += op.Len()
+		case 'S':
+			query_pos += op.Len()
+		case 'D':
+			if engine.filters.farFromEnds(query_pos, first, last) {
+				engine.countDeletion(family, ref_pos, strand, op.Len())
+			}
+			ref_pos += op.Len()
+		case 'N':
+			ref_pos += op.Len()
+		}
+	}
+}
+
+// familyCounts gives the counts of a family at a position
+func (engine *pileupEngine) familyCounts(family pileupFamily, pos int) *pileupCounts {
+	families, found := engine.window[pos]
+	if !found {
+		families = make(map[pileupFamily]*pileupCounts)
+		engine.window[pos] = families
+	}
+	counts, found := families[family]
+	if !found {
+		counts = newPileupCounts()
+		families[family] = counts
+	}
+	return counts
+}
+
+func (engine *pileupEngine) countBase(family pileupFamily, pos int, strand int, base byte, quality byte) {
+	if int(quality) < engine.filters.Min_base_quality || strings.IndexByte(pileup_bases, base) < 0 {
+		return
+	}
+	engine.familyCounts(family, pos).add("alt"+string(base), strand, 1)
+}
+
+// countInsertion counts the bases inserted after a position, when all of them
+// pass the base quality threshold
+func (engine *pileupEngine) countInsertion(family pileupFamily, pos int, strand int, bases []byte, qualities []byte) {
+	for _, quality := range qualities {
+		if int(quality) < engine.filters.Min_base_quality {
+			return
+		}
+	}
+	engine.familyCounts(family, pos).add("ins"+string(bases), strand, 1)
+}
+
+// countDeletion counts a deletion at the position it starts at, the read
+// spanning every deleted position
+func (engine *pileupEngine) countDeletion(family pileupFamily, pos int, strand int, length int) {
+	engine.familyCounts(family, pos).add("del"+strconv.Itoa(length), strand, 1)
+	for i := 0; i < length; i++ {
+		engine.familyCounts(family, pos+i).deleted[strand]++
+	}
+}
+
+// cellCounts gives the counts of every cell at a position, from the consensus
+// alleles of every UMI family when used. A UMI counts once for the base its
+// reads agree on, or for spanning the position with a deletion, and once for
+// an indel starting at the position they agree on, on the strand most of the
+// reads with that allele are on.
+func (engine *pileupEngine) cellCounts(families map[pileupFamily]*pileupCounts) map[string]*pileupCounts {
+	cells := make(map[string]*pileupCounts)
+	for family, counts := range families {
+		if engine.consensus == nil {
+			cells[family.label] = counts
+			continue
+		}
+
+		family_size := counts.coverage()
+		if family_size < engine.consensus.min_family_size {
+			continue
+		}
+		agreed := func(reads int) bool {
+			return reads > 0 && float64(reads) >= engine.consensus.min_agreement*float64(family_size)
+		}
+		majorStrand := func(fwd int, rev int) int {
+			if fwd >= rev {
+				return strand_fwd
+			}
+			return strand_rev
+		}
+
+		cell_counts, found := cells[family.label]
+		if !found {
+			cell_counts = newPileupCounts()
+			cells[family.label] = cell_counts
+		}
+
+		consensus_base := ""
+		for _, base := range pileup_bases {
+			allele := "alt" + string(base)
+			if consensus_base == "" || counts.total(allele) > counts.total(consensus_base) {
+				consensus_base = allele
+			}
+		}
+		deleted := counts.deleted[strand_fwd] + counts.deleted[strand_rev]
+		switch {
+		case agreed(counts.total(consensus_base)) && counts.total(consensus_base) >= deleted:
+			cell_counts.add(consensus_base, majorStrand(counts.strandCount(consensus_base, strand_fwd), counts.strandCount(consensus_base, strand_rev)), 1)
+		case agreed(deleted):
+			cell_counts.deleted[majorStrand(counts.deleted[strand_fwd], counts.deleted[strand_rev])]++
+		}
+
+		for allele := range counts.alleles {
+			if strings.HasPrefix(allele, "alt") || !agreed(counts.total(allele)) {
+				continue
+			}
+			cell_counts.add(allele, majorStrand(counts.strandCount(allele, strand_fwd), counts.strandCount(allele, strand_rev)), 1)
+		}
+	}
+	return cells
+}
+
+// strandStats writes the strand correlation of every allele seen at a position
+// across the cells covering it, giving the alleles the strand filter leaves out
+func (engine *pileupEngine) strandStats(pos int, ref_base string, labels []string, cells map[string]*pileupCounts) map[string]bool {
+	seen := newPileupCounts()
+	for _, label := range labels {
+		for allele, allele_counts := range cells[label].alleles {
+			seen.add(allele, strand_fwd, allele_counts[strand_fwd])
+			seen.add(allele, strand_rev, allele_counts[strand_rev])
+		}
+	}
+
+	// the most common base is kept along with the reference base, which is
+	// unknown without reference_fasta
+	major := ""
+	for _, base := range pileup_bases {
+		if allele := "alt" + string(base); major == "" || seen.total(allele) > seen.total(major) {
+			major = allele
+		}
+	}
+
+	filtered := make(map[string]bool)
+	for _, allele := range seen.names() {
+		fwd := make([]float64, len(labels))
+		rev := make([]float64, len(labels))
+		with_allele := 0
+		for i, label := range labels {
+			counts := cells[label]
+			fwd[i] = float64(counts.strandCount(allele, strand_fwd))
+			rev[i] = float64(counts.strandCount(allele, strand_rev))
+			if counts.total(allele) > 0 {
+				with_allele++
+			}
+		}
+
+		correlation, defined := strandCorrelation(fwd, rev)
+		correlation_str := "NA"
+		if defined {
+			correlation_str = strconv.FormatFloat(correlation, 'f', 4, 64)
+		}
+		name := "pos" + strconv.Itoa(pos+1) + "_" + allele
+		engine.variant_stats.row(name, ref_base, strconv.Itoa(with_allele),
+			strconv.Itoa(seen.strandCount(allele, strand_fwd)), strconv.Itoa(seen.strandCount(allele, strand_rev)), correlation_str)
+
+		if engine.strand != nil && defined && allele != "alt"+ref_base && allele != major &&
+			with_allele >= engine.strand.min_cells && correlation < engine.strand.min_correlation {
+			filtered[allele] = true
+			engine.strand_filtered++
+		}
+	}
+	return filtered
+}
+
+// flush writes out the counts of the positions before the given one, as
+// "pos<N>_alt<B>" rows with 1-based positions like callVars.R names them, or
+// "pos<N>_del<length>" and "pos<N>_ins<sequence>" for indels, along with the
+// reference base at the position and the counts on each strand. The coverage
+// of every row is that of the position, reads deleted over it included.
+func (engine *pileupEngine) flush(before int) {
+	var positions []int
+	for pos := range engine.window {
+		if pos < before {
+			positions = append(positions, pos)
+		}
+	}
+	sort.Ints(positions)
+
+	for _, pos := range positions {
+		cells := engine.cellCounts(engine.window[pos])
+		delete(engine.window, pos)
+		ref_base := referenceBase(engine.reference, pos)
+
+		labels := make([]string, 0, len(cells))
+		for label, counts := range cells {
+			if counts.coverage() > 0 {
+				labels = append(labels, label)
+			}
+		}
+		sort.Strings(labels)
+		filtered := engine.strandStats(pos, ref_base, labels, cells)
+
+		for _, label := range labels {
+			counts := cells[label]
+			// Calls and Coverage count the forward strand, like the uppercase
+			// columns of bam2R callVars.R has always used
+			coverage := []string{
+				strconv.Itoa(counts.strandCoverage(strand_fwd)),
+				strconv.Itoa(counts.strandCoverage(strand_fwd)),
+				strconv.Itoa(counts.strandCoverage(strand_rev))}
+			for _, allele := range counts.names() {
+				if filtered[allele] {
+					continue
+				}
+				name := "pos" + strconv.Itoa(pos+1) + "_" + allele
+				engine.calls.row(label, name, ref_base,
+					strconv.Itoa(counts.strandCount(allele, strand_fwd)),
+					strconv.Itoa(counts.strandCount(allele, strand_fwd)),
+					strconv.Itoa(counts.strandCount(allele, strand_rev)))
+				engine.coverage.row(append([]string{label, name, ref_base}, coverage...)...)
+				engine.covered[label] = true
+			}
+		}
+	}
+}
+
+// runPileup streams the bam once, writing the calls and coverage of every
+// cell to long format tables, and the strand correlation of every variant
+func runPileup(bam_path string, contig string, cells []barcode, filters readFilters, consensus *consensusOptions, strand *strandFilter, reference []byte, calls_path string, coverage_path string, stats_path string) (*pileupSummary, error) {
+	file, err := os.Open(bam_path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := bam.NewReader(bufio.NewReaderSize(file, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", bam_path, err)
+	}
+	ref_id := reader.Header.RefID(contig)
+	if ref_id < 0 {
+		return nil, fmt.Errorf("contig %s is not in the header of %s", contig, bam_path)
+	}
+
+	engine := &pileupEngine{
+		ref_id:    ref_id,
+		labels:    make(map[string]string),
+		filters:   filters,
+		consensus: consensus,
+		strand:    strand,
+		reference: reference,
+		window:    make(map[int]map[pileupFamily]*pileupCounts),
+		umi_reads: make(map[pileupFamily]int),
+		covered:   make(map[string]bool),
+	}
+	for _, cell := range cells {
+		engine.labels[cell.Name] = cellLabel(cell.Name)
+	}
+
+	engine.calls, err = newTableWriter(calls_path, "Cell", "Name", "Ref", "Calls", "Calls_fwd", "Calls_rev")
+	if err != nil {
+		return nil, err
+	}
+	engine.coverage, err = newTableWriter(coverage_path, "Cell", "Name", "Ref", "Coverage", "Coverage_fwd", "Coverage_rev")
+	if err != nil {
+		engine.calls.Close()
+		return nil, err
+	}
+	engine.variant_stats, err = newTableWriter(stats_path, "Name", "Ref", "Cells", "Calls_fwd", "Calls_rev", "Strand_correlation")
+	if err != nil {
+		engine.calls.Close()
+		engine.coverage.Close()
+		return nil, err
+	}
+
+	last_pos := -1
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			engine.calls.Close()
+			engine.coverage.Close()
+			engine.variant_stats.Close()
+			return nil, fmt.Errorf("%s: %w", bam_path, err)
+		}
+		if rec.Ref_id == ref_id && rec.Pos > last_pos {
+			engine.flush(rec.Pos)
+			last_pos = rec.Pos
+		}
+		engine.add(rec)
+	}
+	engine.flush(reader.Header.Refs[ref_id].Length + 1)
+
+	if err := engine.calls.Close(); err != nil {
+		return nil, err
+	}
+	if err := engine.coverage.Close(); err != nil {
+		return nil, err
+	}
+	if err := engine.variant_stats.Close(); err != nil {
+		return nil, err
+	}
+
+	summary := &pileupSummary{covered: engine.covered, family_sizes: make(map[string]map[int]int), strand_filtered: engine.strand_filtered}
+	for family, reads := range engine.umi_reads {
+		if summary.family_sizes[family.label] == nil {
+			summary.family_sizes[family.label] = make(map[int]int)
+		}
+		summary.family_sizes[family.label][reads]++
+	}
+	return summary, nil
+}
+
+// writeFamilySizes writes how many UMIs of every cell had each number of reads
+func writeFamilySizes(path string, family_sizes map[string]map[int]int) error {
+	table, err := newTableWriter(path, "Cell", "Family_size", "UMIs")
+	if err != nil {
+		return err
+	}
+
+	labels := make([]string, 0, len(family_sizes))
+	for label := range family_sizes {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		sizes := make([]int, 0, len(family_sizes[label]))
+		for size := range family_sizes[label] {
+			sizes = append(sizes, size)
+		}
+		sort.Ints(sizes)
+		for _, size := range sizes {
+			table.row(label, strconv.Itoa(size), strconv.Itoa(family_sizes[label][size]))
+		}
+	}
+	return table.Close()
+}
+
+// useNativeVarcall tells whether step 8 counts the bases of every cell with a
+// single pileup of the deduped bam rather than splitting it into per-cell bams
+// for callVars.R
+func useNativeVarcall() bool {
+	return viper.GetString("varcall_engine") == "native"
+}
+
+func pileupOutput() string { return output_dir + "/pileup/" }
+
+func pileupTablePaths() (string, string) {
+	return pileupOutput() + "calls.tsv.gz", pileupOutput() + "coverage.tsv.gz"
+}
+
+func pileupRdsPaths() (string, string) {
+	return pileupOutput() + "pileup.calls.rds", pileupOutput() + "pileup.coverage.rds"
+}
+
+// variantStatsPath has the strand correlation of every variant across cells
+func variantStatsPath() string { return pileupOutput() + "variant_stats.tsv.gz" }
+
+func familySizesPath() string { return pileupOutput() + "umi_family_sizes.tsv.gz" }
+
+// pileupInput is the deduped bam, or the bam from before deduplication when
+// calling consensus bases as the reads of every UMI are needed
+func pileupInput() string {
+	if consensusFromConfig() != nil {
+		return qcSubsetPath()
+	}
+	return dedupedPath()
+}
+
+// pileupJob counts the bases of the cells in process, what it found about them
+// being put in summary
+func pileupJob(input_bam string, cells []barcode, summary **pileupSummary) job {
+	calls_path, coverage_path := pileupTablePaths()
+	consensus := consensusFromConfig()
+	strand := strandFilterFromConfig()
+
+	description := fmt.Sprintf("count the bases of every cell in %s passing %s into %s and %s", input_bam, read_filters, calls_path, coverage_path)
+	if consensus != nil {
+		description = fmt.Sprintf("count the consensus bases of the UMIs of every cell in %s passing %s, from at least %d reads agreeing at %g, into %s and %s, with their family sizes in %s",
+			input_bam, read_filters, consensus.min_family_size, consensus.min_agreement, calls_path, coverage_path, familySizesPath())
+	}
+	description += ", with the strand correlation of every variant in " + variantStatsPath()
+	if strand != nil {
+		description += fmt.Sprintf(", leaving out the variants of at least %d cells with a strand correlation under %g", strand.min_cells, strand.min_correlation)
+	}
+
+	return job{
+		Name: "pileup",
+		Native: &nativeTask{
+			Description: description,
+			run: func() error {
+				reference, err := referenceSequence()
+				if err != nil {
+					return err
+				}
+				*summary, err = runPileup(input_bam, mt_contig.Name, cells, read_filters, consensus, strand, reference, calls_path, coverage_path, variantStatsPath())
+				if err != nil {
+					return err
+				}
+				log.Println(fmt.Sprintf("Found coverage for %d of %d cells", len((*summary).covered), len(cells)))
+				if strand != nil {
+					log.Println(fmt.Sprintf("Left out %d variants with discordant strands", (*summary).strand_filtered))
+				}
+				if consensus != nil {
+					return writeFamilySizes(familySizesPath(), (*summary).family_sizes)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// pileupRdsJob turns the tables of the pileup into the rds tables
+// mergeChunkRds.R expects
+func pileupRdsJob() job {
+	return withResources("pileup_rds", job{
+		Name:    "pileup_rds",
+		Stdout:  pileupOutput() + "pileup_rds.o",
+		Stderr:  pileupOutput() + "pileup_rds.e",
+		Command: []string{Rscript_exec, "pileupToRds.R", pileupOutput()},
+	})
+}
+
+// pileupCellVariants is step 8 with varcall_engine: native
+func pileupCellVariants() error {
+	err := os.MkdirAll(pileupOutput(), 0755)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Counting the bases of every cell in a single pileup")
+	var summary *pileupSummary
+	err = runJob(pileupJob(pileupInput(), barcode_list[1:], &summary), &barcode_list[0])
+	if err != nil {
+		return err
+	}
+
+	calls_path, coverage_path := pileupTablePaths()
+	for i := range barcode_list[1:] {
+		cell := &barcode_list[i+1]
+		cell.Rvarcall_dir_out = pileupOutput()
+		cell.Rvarcall_call_out = calls_path
+		cell.Rvarcall_cov_out = coverage_path
+		cell.Rvarcall_command_successful = summary.covered[cellLabel(cell.Name)]
+		cell.Umi_family_sizes = summary.family_sizes[cellLabel(cell.Name)]
+	}
+
+	err = runJob(pileupRdsJob(), &barcode_list[0])
+	if err != nil {
+		return err
+	}
+
+	rds_calls, rds_coverage := pileupRdsPaths()
+	for i := range barcode_list[1:] {
+		cell := &barcode_list[i+1]
+		if cell.Rvarcall_command_successful {
+			cell.Rdsmerge_rds_calls = rds_calls
+			cell.Rdsmerge_rds_coverage = rds_coverage
+			cell.Rdsmerge_success = true
+		}
+	}
+	return nil
+}
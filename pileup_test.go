@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"scVarCall/bam"
+)
+
+// useDefaultBarcodePattern parses barcodes with the default barcode_pattern
+func useDefaultBarcodePattern(t *testing.T) {
+	t.Helper()
+	previous := barcode_pattern
+	barcode_pattern = regexp.MustCompile(`^([ACGTN]+)(?:-([0-9]+))?$`)
+	t.Cleanup(func() { barcode_pattern = previous })
+}
+
+// testRead is a read of a test bam, its CIGAR given as a string
+type testRead struct {
+	cell    string
+	pos     int
+	cigar   string
+	seq     string
+	qual    []byte // all 35 when nil
+	mapq    uint8
+	reverse bool
+	umi     string
+	name    string
+	// flags besides reverse, a pair with a mapped mate having it on MT at
+	// mate_pos with the template length tlen
+	flag     uint16
+	mate_pos int
+	tlen     int
+}
+
+func parseTestCigar(t *testing.T, cigar string) []bam.CigarOp {
+	t.Helper()
+	var ops []bam.CigarOp
+	for _, match := range regexp.MustCompile(`(\d+)([MIDNS])`).FindAllStringSubmatch(cigar, -1) {
+		length, _ := strconv.Atoi(match[1])
+		ops = append(ops, bam.NewCigarOp(match[2][0], length))
+	}
+	return ops
+}
+
+// writeMTBam writes the reads to an indexed bam with a single MT contig of
+// the given length, sorting them by position
+func writeMTBam(t *testing.T, path string, length int, reads []testRead) {
+	t.Helper()
+	sort.SliceStable(reads, func(i, j int) bool { return reads[i].pos < reads[j].pos })
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	buffered := bufio.NewWriter(file)
+	header := &bam.Header{
+		Text: "@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:MT\tLN:" + strconv.Itoa(length) + "\n",
+		Refs: []bam.Reference{{Name: "MT", Length: length}},
+	}
+	writer, err := bam.NewWriter(buffered, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, read := range reads {
+		qual := read.qual
+		if qual == nil {
+			qual = []byte(strings.Repeat("\x23", len(read.seq)))
+		}
+		name := read.name
+		if name == "" {
+			name = "read" + strconv.Itoa(i)
+		}
+		rec := &bam.Record{
+			Name:        name,
+			Pos:         read.pos,
+			Mapq:        read.mapq,
+			Cigar:       parseTestCigar(t, read.cigar),
+			Next_ref_id: -1,
+			Next_pos:    -1,
+			Seq:         []byte(read.seq),
+			Qual:        qual,
+		}
+		if read.reverse {
+			rec.Flag |= bam.FlagReverse
+		}
+		rec.Flag |= read.flag
+		if read.flag&bam.FlagPaired != 0 && read.flag&bam.FlagMateUnmapped == 0 {
+			rec.Next_ref_id, rec.Next_pos, rec.Tlen = 0, read.mate_pos, read.tlen
+		}
+		if read.cell != "" {
+			rec.SetTagString("CB", read.cell)
+		}
+		if read.umi != "" {
+			rec.SetTagString("UB", read.umi)
+		}
+		if err := writer.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := buffered.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bam.IndexFile(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pileupRow are the counts of an allele of a cell: calls, calls on each
+// strand, coverage and coverage on each strand
+type pileupRow [6]int
+
+// readPileupTables reads the calls and coverage tables of the pileup by cell and row name
+func readPileupTables(t *testing.T, calls_path string, coverage_path string) map[string]map[string]pileupRow {
+	t.Helper()
+	rows := make(map[string]map[string]pileupRow)
+	for table_i, path := range []string{calls_path, coverage_path} {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(gz)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n")[1:] {
+			fields := strings.Split(line, "\t")
+			if rows[fields[0]] == nil {
+				rows[fields[0]] = make(map[string]pileupRow)
+			}
+			row := rows[fields[0]][fields[1]]
+			for i := 0; i < 3; i++ {
+				row[3*table_i+i], _ = strconv.Atoi(fields[3+i])
+			}
+			rows[fields[0]][fields[1]] = row
+		}
+	}
+	return rows
+}
+
+func defaultReadFilters() readFilters {
+	return readFilters{Min_base_quality: 24, Min_mapping_quality: 24, Max_soft_clip: -1, Max_mismatches: -1}
+}
+
+func runTestPileup(t *testing.T, bam_path string, cells []string, filters readFilters, strand *strandFilter, reference []byte) map[string]map[string]pileupRow {
+	t.Helper()
+	dir := t.TempDir()
+	var barcodes []barcode
+	for _, cell := range cells {
+		barcodes = append(barcodes, barcode{Name: cell})
+	}
+	calls_path, coverage_path := filepath.Join(dir, "calls.tsv.gz"), filepath.Join(dir, "coverage.tsv.gz")
+	_, err := runPileup(bam_path, "MT", barcodes, filters, nil, strand, reference, calls_path, coverage_path, filepath.Join(dir, "stats.tsv.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readPileupTables(t, calls_path, coverage_path)
+}
+
+func TestPileupCounts(t *testing.T) {
+	useDefaultBarcodePattern(t)
+	bam_path := filepath.Join(t.TempDir(), "mt.bam")
+	writeMTBam(t, bam_path, 100, []testRead{
+		{cell: "AAAC-1", pos: 0, cigar: "5M", seq: "ACGTA", mapq: 60},
+		{cell: "AAAC-1", pos: 0, cigar: "5M", seq: "ACCTA", mapq: 60, reverse: true},
+		// left out for its mapping quality, then for the quality of its third base
+		{cell: "AAAC-1", pos: 0, cigar: "5M", seq: "ACGTA", mapq: 10},
+		{cell: "AAAC-1", pos: 0, cigar: "5M", seq: "ACGTA", mapq: 60, qual: []byte{35, 35, 10, 35, 35}},
+		{cell: "GGGT-1", pos: 1, cigar: "2M2D1M", seq: "CGA", mapq: 60, reverse: true},
+		// not a cell of the run
+		{cell: "TTTT-1", pos: 0, cigar: "5M", seq: "ACGTA", mapq: 60},
+	})
+
+	rows := runTestPileup(t, bam_path, []string{"AAAC-1", "GGGT-1"}, defaultReadFilters(), nil, nil)
+
+	// Calls and Coverage count the forward strand
+	expected := map[string]map[string]pileupRow{
+		"cell_AAAC": {
+			"pos1_altA": {2, 2, 1, 2, 2, 1},
+			"pos2_altC": {2, 2, 1, 2, 2, 1},
+			"pos3_altG": {1, 1, 0, 1, 1, 1},
+			"pos3_altC": {0, 0, 1, 1, 1, 1},
+			"pos4_altT": {2, 2, 1, 2, 2, 1},
+			"pos5_altA": {2, 2, 1, 2, 2, 1},
+		},
+		"cell_GGGT": {
+			"pos2_altC": {0, 0, 1, 0, 0, 1},
+			"pos3_altG": {0, 0, 1, 0, 0, 1},
+			"pos4_del2": {0, 0, 1, 0, 0, 1},
+			"pos6_altA": {0, 0, 1, 0, 0, 1},
+		},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("got pileup\n%v\nexpected\n%v", rows, expected)
+	}
+}
+
+func TestStrandCorrelation(t *testing.T) {
+	tests := []struct {
+		fwd, rev    []float64
+		correlation float64
+		defined     bool
+	}{
+		{[]float64{1, 2, 3}, []float64{2, 4, 6}, 1, true},
+		{[]float64{3, 0, 2}, []float64{0, 3, 1}, -1, true},
+		{[]float64{1, 2, 3}, []float64{2, 2, 2}, 0, false},
+		{[]float64{5}, []float64{5}, 0, false},
+	}
+	for _, test := range tests {
+		correlation, defined := strandCorrelation(test.fwd, test.rev)
+		if defined != test.defined || math.Abs(correlation-test.correlation) > 1e-9 {
+			t.Errorf("fwd %v rev %v gave %v (defined %v), expected %v (defined %v)",
+				test.fwd, test.rev, correlation, defined, test.correlation, test.defined)
+		}
+	}
+}
+
+func TestPileupStrandFilter(t *testing.T) {
+	useDefaultBarcodePattern(t)
+	bam_path := filepath.Join(t.TempDir(), "mt.bam")
+	var reads []testRead
+	add := func(cell string, seq string, fwd int, rev int) {
+		for i := 0; i < fwd+rev; i++ {
+			reads = append(reads, testRead{cell: cell, pos: 0, cigar: "1M", seq: seq, mapq: 60, reverse: i >= fwd})
+		}
+	}
+	// the forward and reverse counts of both bases disagree across the cells
+	add("AAAC-1", "A", 3, 0)
+	add("AAAC-1", "C", 1, 0)
+	add("GGGT-1", "A", 0, 3)
+	add("GGGT-1", "C", 0, 1)
+	add("TTTG-1", "A", 2, 1)
+	add("TTTG-1", "C", 1, 0)
+	writeMTBam(t, bam_path, 100, reads)
+
+	strand := &strandFilter{min_correlation: 0.65, min_cells: 2}
+	rows := runTestPileup(t, bam_path, []string{"AAAC-1", "GGGT-1", "TTTG-1"}, defaultReadFilters(), strand, nil)
+
+	// without a reference, the most common base is kept
+	for _, cell := range []string{"cell_AAAC", "cell_GGGT", "cell_TTTG"} {
+		if _, found := rows[cell]["pos1_altA"]; !found {
+			t.Errorf("the most common base was left out of %s: %v", cell, rows[cell])
+		}
+		if _, found := rows[cell]["pos1_altC"]; found {
+			t.Errorf("the strand specific variant was kept in %s: %v", cell, rows[cell])
+		}
+	}
+
+	// with one, the reference base is kept too
+	reference := []byte(strings.Repeat("C", 100))
+	rows = runTestPileup(t, bam_path, []string{"AAAC-1", "GGGT-1", "TTTG-1"}, defaultReadFilters(), strand, reference)
+	for _, allele := range []string{"pos1_altA", "pos1_altC"} {
+		if _, found := rows["cell_AAAC"][allele]; !found {
+			t.Errorf("%s was left out with C as reference: %v", allele, rows["cell_AAAC"])
+		}
+	}
+}
+
+func TestPileupUnknownContig(t *testing.T) {
+	bam_path := filepath.Join(t.TempDir(), "mt.bam")
+	writeMTBam(t, bam_path, 100, []testRead{{cell: "AAAC-1", pos: 0, cigar: "4M", seq: "ACGT", mapq: 60}})
+
+	dir := t.TempDir()
+	_, err := runPileup(bam_path, "chrM", []barcode{{Name: "AAAC-1"}}, defaultReadFilters(), nil, nil, nil,
+		filepath.Join(dir, "calls.tsv.gz"), filepath.Join(dir, "coverage.tsv.gz"), filepath.Join(dir, "stats.tsv.gz"))
+	if err == nil {
+		t.Error("expected an error for a contig that isn't in the header")
+	}
+}
+
+// callVarsRows runs callVars.R on the bam of a single cell and reads back the
+// rds tables it writes. The renv::restore of the script is left out so the
+// installed R library is used.
+func callVarsRows(t *testing.T, bam_path string, label string, filters readFilters) map[string]pileupRow {
+	t.Helper()
+	dir := t.TempDir()
+
+	script, err := ioutil.ReadFile("callVars.R")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(script), "\n") {
+		if !strings.HasPrefix(line, "renv::") {
+			lines = append(lines, line)
+		}
+	}
+	script_path := filepath.Join(dir, "callVars.R")
+	if err := ioutil.WriteFile(script_path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	args := append([]string{script_path, bam_path, dir, "MT", "300", label}, filters.callVarsArgs()...)
+	if output, err := exec.Command("Rscript", args...).CombinedOutput(); err != nil {
+		t.Fatalf("callVars.R failed: %s\n%s", err, output)
+	}
+
+	dump := `args <- commandArgs(trailingOnly = TRUE)
+columns <- c("calls", "calls_fwd", "calls_rev", "coverage", "coverage_fwd", "coverage_rev")
+tables <- lapply(columns, function(column) readRDS(paste0(args[1], "/", args[2], ".", column, ".rds")))
+for (i in seq_len(nrow(tables[[1]]))) {
+  cat(rownames(tables[[1]])[i], sapply(tables, function(table) table[i, 1]), sep = "\t")
+  cat("\n")
+}`
+	output, err := exec.Command("Rscript", "-e", dump, dir, label).Output()
+	if err != nil {
+		t.Fatalf("unable to read the rds tables of callVars.R: %s", err)
+	}
+	rows := make(map[string]pileupRow)
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		var row pileupRow
+		for i := range row {
+			value, _ := strconv.ParseFloat(fields[i+1], 64)
+			row[i] = int(value)
+		}
+		rows[fields[0]] = row
+	}
+	return rows
+}
+
+// TestPileupMatchesCallVars checks the native pileup counts the same bases as
+// bam2R through callVars.R, with the same read filters, on random reads
+func TestPileupMatchesCallVars(t *testing.T) {
+	if _, err := exec.LookPath("Rscript"); err != nil {
+		t.Skip("Rscript is not installed")
+	}
+	if err := exec.Command("Rscript", "-e", "suppressPackageStartupMessages(library(deepSNV))").Run(); err != nil {
+		t.Skip("deepSNV is not installed")
+	}
+	useDefaultBarcodePattern(t)
+
+	random := rand.New(rand.NewSource(1))
+	reference := make([]byte, 300)
+	for i := range reference {
+		reference[i] = "ACGT"[random.Intn(4)]
+	}
+	cells := []string{"AAACCCAAGAAACCAT-1", "AAAGAACCAATGTGGG-1"}
+	var reads []testRead
+	for i := 0; i < 400; i++ {
+		pos := random.Intn(240)
+		cigar, read_len := "50M", 50
+		seq := []byte(string(reference[pos : pos+50]))
+		if random.Intn(8) == 0 {
+			// a deletion of 3 bases in the middle of the read
+			cigar = "25M3D25M"
+			seq = append(append([]byte{}, reference[pos:pos+25]...), reference[pos+28:pos+53]...)
+		}
+		qual := make([]byte, read_len)
+		for j := range seq {
+			if random.Intn(10) == 0 {
+				seq[j] = "ACGT"[random.Intn(4)]
+			}
+			qual[j] = 35
+			if random.Intn(10) == 0 {
+				qual[j] = 10
+			}
+		}
+		mapq := uint8(60)
+		if random.Intn(10) == 0 {
+			mapq = 10
+		}
+		reads = append(reads, testRead{
+			cell: cells[random.Intn(2)], pos: pos, cigar: cigar, seq: string(seq), qual: qual,
+			mapq: mapq, reverse: random.Intn(2) == 0,
+		})
+	}
+
+	dir := t.TempDir()
+	pileup := runTestPileup(t, writeCellBams(t, dir, reads, cells), cells, defaultReadFilters(), nil, nil)
+
+	for _, cell := range cells {
+		label := cellLabel(cell)
+		native := make(map[string]pileupRow)
+		for name, row := range pileup[label] {
+			if strings.Contains(name, "_alt") {
+				native[name] = row
+			}
+		}
+		callvars := make(map[string]pileupRow)
+		for name, row := range callVarsRows(t, filepath.Join(dir, label+".bam"), label, defaultReadFilters()) {
+			if strings.Contains(name, "_alt") {
+				callvars[name] = row
+			}
+		}
+		if len(native) == 0 {
+			t.Fatalf("no calls for %s", label)
+		}
+		if !reflect.DeepEqual(native, callvars) {
+			for name, row := range native {
+				if callvars[name] != row {
+					t.Errorf("%s %s: native pileup gives %v, callVars.R %v", label, name, row, callvars[name])
+				}
+			}
+			for name, row := range callvars {
+				if _, found := native[name]; !found {
+					t.Errorf("%s %s: only callVars.R gives %v", label, name, row)
+				}
+			}
+		}
+	}
+}
+
+// writeCellBams writes the reads of all cells to all.bam, and those of every
+// cell to <label>.bam like the split of step 8 does, returning the path of all.bam
+func writeCellBams(t *testing.T, dir string, reads []testRead, cells []string) string {
+	t.Helper()
+	all_path := filepath.Join(dir, "all.bam")
+	writeMTBam(t, all_path, 300, append([]testRead{}, reads...))
+	for _, cell := range cells {
+		var cell_reads []testRead
+		for _, read := range reads {
+			if read.cell == cell {
+				cell_reads = append(cell_reads, read)
+			}
+		}
+		writeMTBam(t, filepath.Join(dir, cellLabel(cell)+".bam"), 300, cell_reads)
+	}
+	return all_path
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// pipeline chains commands together by connecting the stdout of each stage to
+// the stdin of the next with pipes, optionally writing the output of the last
+// one to a file, all without going through a shell
+type pipeline struct {
+	Stages [][]string
+	Output string `json:",omitempty"`
+}
+
+func newPipeline(command ...string) *pipeline {
+	return &pipeline{Stages: [][]string{command}}
+}
+
+// pipe adds a command reading the output of the previous stage
+func (p *pipeline) pipe(command ...string) *pipeline {
+	p.Stages = append(p.Stages, command)
+	return p
+}
+
+// to redirects the output of the last stage to a file
+func (p *pipeline) to(file string) *pipeline {
+	p.Output = file
+	return p
+}
+
+// String returns the shell equivalent of the pipeline, which is what gets
+// recorded in the checkpoint and run by the schedulers
+func (p *pipeline) String() string {
+	stages := make([]string, len(p.Stages))
+	for i, stage := range p.Stages {
+		stages[i] = shellJoin(stage)
+	}
+	command_line := strings.Join(stages, " | ")
+	if p.Output != "" {
+		command_line += " > " + shellJoin([]string{p.Output})
+	}
+	return command_line
+}
+
+// runningPipeline holds the processes of a pipeline that was started
+type runningPipeline struct {
+	pipeline *pipeline
+	cmds     []*exec.Cmd
+	files    []*os.File
+}
+
+// start launches every stage of the pipeline. The output of the last stage goes
+// to stdout unless the pipeline redirects it to a file, and the stderr of all
+// stages goes to stderr.
+func (p *pipeline) start(stdout io.Writer, stderr io.Writer) (*runningPipeline, error) {
+	running := &runningPipeline{pipeline: p}
+
+	var stage_input *os.File
+	if p.Output != "" {
+		output_file, err := os.Create(p.Output)
+		if err != nil {
+			running.close()
+			return nil, err
+		}
+		running.files = append(running.files, output_file)
+		stdout = output_file
+	}
+
+	// both ends of the pipes between stages, closed on our side once every stage has started
+	var pipe_ends []*os.File
+	for i, stage := range p.Stages {
+		if len(stage) == 0 {
+			running.close()
+			return nil, fmt.Errorf("stage %d of pipeline is empty", i+1)
+		}
+
+		cmd := exec.Command(stage[0], stage[1:]...)
+		cmd.Stderr = stderr
+		if stage_input != nil {
+			cmd.Stdin = stage_input
+		}
+
+		if i < len(p.Stages)-1 {
+			pipe_reader, pipe_writer, err := os.Pipe()
+			if err != nil {
+				running.close()
+				return nil, err
+			}
+			pipe_ends = append(pipe_ends, pipe_reader, pipe_writer)
+			cmd.Stdout = pipe_writer
+			stage_input = pipe_reader
+		} else {
+			cmd.Stdout = stdout
+		}
+
+		running.cmds = append(running.cmds, cmd)
+	}
+
+	for i, cmd := range running.cmds {
+		if err := cmd.Start(); err != nil {
+			running.cmds = running.cmds[:i]
+			running.kill()
+			for _, pipe_end := range pipe_ends {
+				pipe_end.Close()
+			}
+			running.wait()
+			return nil, fmt.Errorf("unable to start stage %d of pipeline (%s): %w", i+1, p.Stages[i][0], err)
+		}
+	}
+
+	// the children have their own copies, keeping ours open would stop stages from seeing the end of their input
+	for _, pipe_end := range pipe_ends {
+		pipe_end.Close()
+	}
+
+	return running, nil
+}
+
+// wait waits for every stage to exit and returns the error of the first stage
+// that failed, so the exit status of every stage is taken into account
+func (running *runningPipeline) wait() error {
+	var first_err error
+	for i, cmd := range running.cmds {
+		err := cmd.Wait()
+		if err != nil && first_err == nil {
+			first_err = fmt.Errorf("stage %d of pipeline (%s) failed: %w", i+1, running.pipeline.Stages[i][0], err)
+		}
+	}
+	running.close()
+	return first_err
+}
+
+func (running *runningPipeline) kill() {
+	for _, cmd := range running.cmds {
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	}
+}
+
+func (running *runningPipeline) close() {
+	for _, file := range running.files {
+		file.Close()
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// plannedJob is a job as it would be submitted by a run
+type plannedJob struct {
+	Name       string
+	Native     bool   `json:",omitempty"` // run in the pipeline process rather than submitted
+	Array      string `json:",omitempty"` // name of the job array the task is part of
+	Tasks      int    `json:",omitempty"` // number of tasks of a job array
+	Command    string
+	Memory     int `json:",omitempty"`
+	Cores      int
+	Walltime   string   `json:",omitempty"`
+	Queue      string   `json:",omitempty"`
+	Extra_args []string `json:",omitempty"`
+	Inputs     []string
+	Outputs    []string
+	Stdout     string
+	Stderr     string
+}
+
+// plannedStep is what a step of the pipeline would do, or that it would be
+// skipped when its checkpoint already exists
+type plannedStep struct {
+	Step        int
+	Description string
+	Checkpoint  string
+	Skipped     bool
+	Created     []string     `json:",omitempty"` // files and directories written by scVarCall itself
+	Jobs        []plannedJob `json:",omitempty"`
+	Notes       []string     `json:",omitempty"`
+}
+
+type executionPlan struct {
+	Sample     string `json:",omitempty"`
+	Input      string
+	Barcodes   string
+	Output_dir string
+	Executor   string
+	Steps      []plannedStep
+}
+
+func planJob(j job, inputs []string, outputs []string) plannedJob {
+	planned := plannedJob{
+		Name:       j.Name,
+		Native:     j.Native != nil,
+		Command:    commandLine(j),
+		Memory:     j.Memory,
+		Cores:      j.Cores,
+		Queue:      j.Queue,
+		Extra_args: j.Extra_args,
+		Inputs:     inputs,
+		Outputs:    outputs,
+		Stdout:     j.Stdout,
+		Stderr:     j.Stderr,
+	}
+	if j.Walltime > 0 {
+		planned.Walltime = j.Walltime.String()
+	}
+	return planned
+}
+
+// buildPlan goes through the steps of the pipeline the way main does, without
+// submitting or writing anything. Steps with a checkpoint are marked as skipped.
+func buildPlan() executionPlan {
+	plan := executionPlan{
+		Input:      input_bam,
+		Barcodes:   barcodes_qc,
+		Output_dir: output_dir,
+		Executor:   viper.GetString("executor"),
+	}
+
+	for i, step := range pipeline_steps {
+		planned := plannedStep{
+			Step:        i + 1,
+			Description: step.Description,
+			Checkpoint:  checkpointPath(i + 1),
+		}
+		if fileExists(planned.Checkpoint) {
+			planned.Skipped = true
+		} else {
+			if fileExists(partialCheckpointPath(i + 1)) {
+				planned.Notes = append(planned.Notes, "resumes from "+partialCheckpointPath(i+1)+", only the cells it didn't finish are run again")
+			}
+			step.plan(&planned)
+		}
+		plan.Steps = append(plan.Steps, planned)
+	}
+	return plan
+}
+
+func planDefineMaster(step *plannedStep) {
+	step.Created = append(step.Created, output_dir)
+	if info, err := os.Stat(output_dir); err == nil && info.IsDir() {
+		step.Notes = append(step.Notes, "output directory already exists without a checkpoint, the run would stop here")
+	}
+}
+
+func planSubsetMT(step *plannedStep) {
+	step.Jobs = append(step.Jobs,
+		planJob(quickcheckJob(input_bam), []string{input_bam}, nil),
+		planJob(mtSubsetJob(input_bam, mtSubsetPath()), []string{input_bam}, []string{mtSubsetPath()}),
+		planJob(quickcheckJob(mtSubsetPath()), []string{mtSubsetPath()}, nil),
+	)
+}
+
+func planIndexMT(step *plannedStep) {
+	step.Jobs = append(step.Jobs,
+		planJob(indexJob(mtSubsetPath()), []string{mtSubsetPath()}, []string{mtSubsetPath() + ".bai"}),
+	)
+}
+
+func planSubsetQC(step *plannedStep) {
+	inputs := []string{mtSubsetPath(), barcodes_qc}
+	if !useNativeBam() {
+		step.Created = append(step.Created, whitelistPath())
+		inputs = []string{mtSubsetPath(), whitelistPath()}
+	}
+	var found int
+	step.Jobs = append(step.Jobs,
+		planJob(qcSubsetJob(mtSubsetPath(), qcSubsetPath(), nil, &found), inputs, []string{qcSubsetPath()}),
+		planJob(quickcheckJob(qcSubsetPath()), []string{qcSubsetPath()}, nil),
+		planJob(indexJob(qcSubsetPath()), []string{qcSubsetPath()}, []string{qcSubsetPath() + ".bai"}),
+	)
+}
+
+func planDedupUMIs(step *plannedStep) {
+	var stats map[string]dedupStats
+	step.Jobs = append(step.Jobs,
+		planJob(umiDedupJob(qcSubsetPath(), dedupedPath(), &stats), []string{qcSubsetPath()}, []string{dedupedPath()}),
+		planJob(quickcheckJob(dedupedPath()), []string{dedupedPath()}, nil),
+	)
+}
+
+func planIndexDeduped(step *plannedStep) {
+	step.Jobs = append(step.Jobs,
+		planJob(indexJob(dedupedPath()), []string{dedupedPath()}, []string{dedupedPath() + ".bai"}),
+	)
+}
+
+func planListBarcodes(step *plannedStep) {
+	step.Jobs = append(step.Jobs,
+		planJob(barcodeStatsJob(dedupedPath()), []string{dedupedPath()}, []string{barcodeStatsPath()}),
+	)
+}
+
+// planCallCellVariants lists the jobs of every cell when the barcodes were
+// already found by step 7, otherwise those of a placeholder cell. With the
+// native pileup there is only the pileup and its rds conversion.
+func planCallCellVariants(step *plannedStep) {
+	if useNativeVarcall() {
+		calls_path, coverage_path := pileupTablePaths()
+		rds_calls, rds_coverage := pileupRdsPaths()
+		outputs := []string{calls_path, coverage_path, variantStatsPath()}
+		if consensusFromConfig() != nil {
+			outputs = append(outputs, familySizesPath())
+		}
+		var summary *pileupSummary
+		step.Created = append(step.Created, pileupOutput())
+		step.Jobs = append(step.Jobs,
+			planJob(pileupJob(pileupInput(), nil, &summary), []string{pileupInput()}, outputs),
+			planJob(pileupRdsJob(), []string{calls_path, coverage_path}, []string{rds_calls, rds_coverage}),
+		)
+		return
+	}
+
+	cells, err := readBarcodeStats(barcodeStatsPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			step.Notes = append(step.Notes, fmt.Sprintf("unable to read %s: %s", barcodeStatsPath(), err))
+		}
+		step.Notes = append(step.Notes, "cell barcodes are only known once step 7 has run, the jobs run for every cell are shown for a placeholder <barcode>")
+		cells = []barcode{{Name: "<barcode>"}}
+	}
+
+	if reference_bases := referenceBasesPath(); reference_bases != "" {
+		step.Created = append(step.Created, reference_bases)
+	}
+
+	_, use_arrays := useJobArrays()
+	for chunk_i, chunk := range chunkSlice(cells, 500) {
+		chunk_output := chunkOutput(chunk_i)
+		step.Created = append(step.Created, chunk_output)
+
+		if use_arrays {
+			manifest_path := chunk_output + "manifest.tsv"
+			step.Created = append(step.Created, manifest_path)
+
+			array_job := cellTaskArrayJob(chunk_output, chunk_i, manifest_path, dedupedPath())
+			planned_array := planJob(array_job, []string{manifest_path, dedupedPath()}, nil)
+			planned_array.Tasks = len(chunk)
+			step.Jobs = append(step.Jobs, planned_array)
+
+			for i := range chunk {
+				cell := &chunk[i]
+				setCellPaths(cell, chunk_output)
+				setCellTaskPaths(cell, chunk_output, manifest_path, i+1)
+				step.Created = append(step.Created, cell.Splitbam_barcodefile)
+
+				task := planJob(arrayTask(array_job, strconv.Itoa(cell.Celltask_index)),
+					[]string{cell.Splitbam_barcodefile, dedupedPath()},
+					[]string{cell.Splitbam_bamout, cell.Splitbam_bamindex, cell.Rvarcall_call_out, cell.Rvarcall_cov_out})
+				task.Array = array_job.Name
+				step.Jobs = append(step.Jobs, task)
+			}
+		} else {
+			for i := range chunk {
+				cell := &chunk[i]
+				setCellPaths(cell, chunk_output)
+				step.Created = append(step.Created, cell.Splitbam_barcodefile)
+
+				step.Jobs = append(step.Jobs,
+					planJob(cellSplitJob(cell, chunk_output, dedupedPath()), []string{dedupedPath(), cell.Splitbam_barcodefile}, []string{cell.Splitbam_bamout}),
+					planJob(cellIndexJob(cell, chunk_output), []string{cell.Splitbam_bamout}, []string{cell.Splitbam_bamindex}),
+					planJob(cellVarcallJob(cell, chunk_output), []string{cell.Splitbam_bamout, cell.Splitbam_bamindex}, []string{cell.Rvarcall_call_out, cell.Rvarcall_cov_out}),
+				)
+			}
+		}
+
+		chunk_calls, chunk_coverage := chunkRdsPaths(chunk_output, chunk_i)
+		merge_inputs := []string{chunk_output}
+		if reference_bases := referenceBasesPath(); reference_bases != "" {
+			merge_inputs = append(merge_inputs, reference_bases)
+		}
+		step.Jobs = append(step.Jobs,
+			planJob(rdsMergeJob(chunk_output, chunk_i), merge_inputs, []string{chunk_calls, chunk_coverage}),
+		)
+	}
+}
+
+// resources describes what the job asks the executor for
+func (planned plannedJob) resources() string {
+	var resources []string
+	if planned.Memory > 0 {
+		resources = append(resources, fmt.Sprintf("%d MB", planned.Memory))
+	}
+	resources = append(resources, fmt.Sprintf("%d cores", planned.Cores))
+	if planned.Walltime != "" {
+		resources = append(resources, "walltime "+planned.Walltime)
+	}
+	if planned.Queue != "" {
+		resources = append(resources, "queue "+planned.Queue)
+	}
+	if len(planned.Extra_args) > 0 {
+		resources = append(resources, "extra args "+shellJoin(planned.Extra_args))
+	}
+	return strings.Join(resources, ", ")
+}
+
+// write prints the plan in a readable form
+func (plan executionPlan) write(w io.Writer) {
+	if plan.Sample != "" {
+		fmt.Fprintf(w, "Dry run of sample %s from %s into %s with the %s executor\n", plan.Sample, plan.Input, plan.Output_dir, plan.Executor)
+	} else {
+		fmt.Fprintf(w, "Dry run of %s into %s with the %s executor\n", plan.Input, plan.Output_dir, plan.Executor)
+	}
+
+	for _, step := range plan.Steps {
+		step.write(w)
+	}
+}
+
+// write prints what a step would do
+func (step plannedStep) write(w io.Writer) {
+	fmt.Fprintf(w, "\nStep %d: %s\n", step.Step, step.Description)
+	if step.Skipped {
+		fmt.Fprintf(w, "  skipped, checkpoint exists at %s\n", step.Checkpoint)
+		return
+	}
+	for _, note := range step.Notes {
+		fmt.Fprintf(w, "  note: %s\n", note)
+	}
+	for _, created := range step.Created {
+		fmt.Fprintf(w, "  creates %s\n", created)
+	}
+	for _, planned := range step.Jobs {
+		switch {
+		case planned.Native:
+			fmt.Fprintf(w, "  in process %s\n", planned.Name)
+		case planned.Tasks > 0:
+			fmt.Fprintf(w, "  job array %s of %d tasks (%s)\n", planned.Name, planned.Tasks, planned.resources())
+		case planned.Array != "":
+			fmt.Fprintf(w, "  task %s of %s\n", planned.Name, planned.Array)
+		default:
+			fmt.Fprintf(w, "  job %s (%s)\n", planned.Name, planned.resources())
+		}
+		fmt.Fprintf(w, "    command: %s\n", planned.Command)
+		if len(planned.Inputs) > 0 {
+			fmt.Fprintf(w, "    inputs:  %s\n", strings.Join(planned.Inputs, " "))
+		}
+		if len(planned.Outputs) > 0 {
+			fmt.Fprintf(w, "    outputs: %s\n", strings.Join(planned.Outputs, " "))
+		}
+		if planned.Stdout != "" || planned.Stderr != "" {
+			fmt.Fprintf(w, "    logs:    %s %s\n", planned.Stdout, planned.Stderr)
+		}
+	}
+	fmt.Fprintf(w, "  then writes %s\n", step.Checkpoint)
+}
+
+func (plan executionPlan) writeJSON(w io.Writer) error {
+	plan_json, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(plan_json))
+	return err
+}
+
+// multiSamplePlan is the plan of every sample of a multi-sample run, followed
+// by the merge of their calls
+type multiSamplePlan struct {
+	Output_dir string
+	Executor   string
+	Samples    []executionPlan
+	Merge      plannedStep
+}
+
+func planSampleMerge(run_output_dir string) plannedStep {
+	merge := plannedStep{
+		Step:        len(pipeline_steps) + 1,
+		Description: "Merge the calls of every sample, select their informative variants and estimate their heteroplasmy",
+		Checkpoint:  mergeCheckpointPath(run_output_dir),
+	}
+	if fileExists(merge.Checkpoint) {
+		merge.Skipped = true
+		return merge
+	}
+	merged_calls, merged_coverage := mergedRdsPaths(run_output_dir)
+	merge.Created = append(merge.Created, sampleCellsPath(run_output_dir))
+	merge.Notes = append(merge.Notes, "cells are named sample:barcode in the merged tables")
+	merge.Jobs = append(merge.Jobs,
+		planJob(sampleMergeJob(run_output_dir), []string{sampleCellsPath(run_output_dir)}, []string{merged_calls, merged_coverage}),
+	)
+	if selection := variantSelectionFromConfig(); selection != nil {
+		planVariantSelection(&merge, []string{merged_calls}, []string{merged_coverage}, run_output_dir, selection)
+	}
+	if model := heteroplasmyModelFromConfig(); model != nil {
+		planHeteroplasmy(&merge, []string{merged_calls}, []string{merged_coverage}, run_output_dir, model)
+	}
+	return merge
+}
+
+func (plan multiSamplePlan) write(w io.Writer) {
+	fmt.Fprintf(w, "Dry run of %d samples into %s with the %s executor\n", len(plan.Samples), plan.Output_dir, plan.Executor)
+	for _, sample_plan := range plan.Samples {
+		fmt.Fprintln(w)
+		sample_plan.write(w)
+	}
+	fmt.Fprintf(w, "\nOnce every sample is done\n")
+	plan.Merge.write(w)
+}
+
+func (plan multiSamplePlan) writeJSON(w io.Writer) error {
+	plan_json, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(plan_json))
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// isCram tells whether the input is a CRAM file, from its magic number when it
+// can be read and from its extension otherwise
+func isCram(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return strings.HasSuffix(strings.ToLower(path), ".cram")
+	}
+	defer file.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false
+	}
+	return string(magic) == "CRAM"
+}
+
+// readFastaContig reads the sequence of a contig from a FASTA file, in upper case
+func readFastaContig(fasta_path string, contig string) ([]byte, error) {
+	file, err := os.Open(fasta_path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var sequence []byte
+	in_contig := false
+	found := false
+	fasta_scanner := bufio.NewScanner(file)
+	fasta_scanner.Buffer(make([]byte, 1<<20), 1<<30)
+	for fasta_scanner.Scan() {
+		line := bytes.TrimSpace(fasta_scanner.Bytes())
+		if len(line) > 0 && line[0] == '>' {
+			if in_contig {
+				break
+			}
+			fields := strings.Fields(string(line[1:]))
+			in_contig = len(fields) > 0 && fields[0] == contig
+			found = found || in_contig
+			continue
+		}
+		if in_contig {
+			sequence = append(sequence, bytes.ToUpper(line)...)
+		}
+	}
+	if err := fasta_scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("contig %s is not in %s", contig, fasta_path)
+	}
+	return sequence, nil
+}
+
+// referenceSequence is the sequence of the MT in reference_fasta, or nil when
+// no reference is given
+func referenceSequence() ([]byte, error) {
+	fasta_path := viper.GetString("reference_fasta")
+	if fasta_path == "" {
+		return nil, nil
+	}
+	return readFastaContig(fasta_path, mt_contig.Name)
+}
+
+// referenceBasesPath is where the MT sequence of reference_fasta is written
+// for mergeVarcallRds.R to name the reference base of every row, empty when
+// no reference is given
+func referenceBasesPath() string {
+	if viper.GetString("reference_fasta") == "" {
+		return ""
+	}
+	return output_dir + "/reference_bases.txt"
+}
+
+// writeReferenceBases writes the MT sequence of reference_fasta on a single
+// line to referenceBasesPath
+func writeReferenceBases() error {
+	reference, err := referenceSequence()
+	if err != nil || reference == nil {
+		return err
+	}
+	return ioutil.WriteFile(referenceBasesPath(), append(reference, '\n'), 0644)
+}
+
+// referenceBase is the base of the reference at a 0-based position, N when
+// unknown
+func referenceBase(reference []byte, pos int) string {
+	if pos < 0 || pos >= len(reference) {
+		return "N"
+	}
+	return string(reference[pos])
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// resourceProfile is what the jobs of a step ask the executor for
+type resourceProfile struct {
+	Memory     int // in MB, 0 leaves it to the backend default
+	Cores      int
+	Walltime   time.Duration
+	Queue      string
+	Extra_args []string
+}
+
+// default_resources are used for every step, or setting of a step, that isn't
+// given in the "resources" section of the config. Every step has a walltime so
+// a job killed for running too long can be retried with more time.
+var default_resources = map[string]resourceProfile{
+	"quickcheck":        {Cores: 1, Walltime: time.Hour},
+	"index":             {Cores: 1, Walltime: 4 * time.Hour},
+	"mt_subset":         {Memory: 50000, Cores: 4, Walltime: 12 * time.Hour},
+	"qc_subset":         {Memory: 5000, Cores: 12, Walltime: 12 * time.Hour},
+	"umi_dedup":         {Memory: 80000, Cores: 1, Walltime: 24 * time.Hour},
+	"cell_split":        {Memory: 5000, Cores: 12, Walltime: 4 * time.Hour},
+	"cell_index":        {Cores: 1, Walltime: time.Hour},
+	"cell_varcall":      {Memory: 5000, Cores: 1, Walltime: 4 * time.Hour},
+	"cell_task":         {Memory: 5000, Cores: 12, Walltime: 8 * time.Hour},
+	"rds_merge":         {Memory: 16000, Cores: 1, Walltime: 4 * time.Hour},
+	"pileup_rds":        {Memory: 16000, Cores: 1, Walltime: 4 * time.Hour},
+	"sample_merge":      {Memory: 32000, Cores: 1, Walltime: 8 * time.Hour},
+	"variant_selection": {Memory: 16000, Cores: 1, Walltime: 4 * time.Hour},
+	"heteroplasmy":      {Memory: 16000, Cores: 1, Walltime: 4 * time.Hour},
+}
+
+var step_resources map[string]resourceProfile
+
+// loadResources reads the resources of every step from the config over the
+// defaults, returning an error for unknown steps or invalid values
+func loadResources() error {
+	step_resources = make(map[string]resourceProfile)
+
+	for step := range viper.GetStringMap("resources") {
+		if _, known := default_resources[strings.ToLower(step)]; !known {
+			return fmt.Errorf("unknown step '%s' in resources, expected one of: %s", step, strings.Join(resourceSteps(), ", "))
+		}
+	}
+
+	for step, profile := range default_resources {
+		key := "resources." + step + "."
+
+		if viper.IsSet(key + "memory") {
+			memory, err := strconv.Atoi(viper.GetString(key + "memory"))
+			if err != nil || memory < 0 {
+				return fmt.Errorf("memory of %s should be a number of MB, got '%s'", step, viper.GetString(key+"memory"))
+			}
+			profile.Memory = memory
+		}
+
+		if viper.IsSet(key + "cores") {
+			cores, err := strconv.Atoi(viper.GetString(key + "cores"))
+			if err != nil || cores < 1 {
+				return fmt.Errorf("cores of %s should be a number above 0, got '%s'", step, viper.GetString(key+"cores"))
+			}
+			profile.Cores = cores
+		}
+
+		if viper.IsSet(key + "walltime") {
+			walltime, err := time.ParseDuration(viper.GetString(key + "walltime"))
+			if err != nil || walltime < 0 {
+				return fmt.Errorf("walltime of %s should be a duration like 90m or 12h, got '%s'", step, viper.GetString(key+"walltime"))
+			}
+			profile.Walltime = walltime
+		}
+
+		if viper.IsSet(key + "queue") {
+			profile.Queue = strings.TrimSpace(viper.GetString(key + "queue"))
+		}
+
+		if viper.IsSet(key + "extra_args") {
+			profile.Extra_args = viper.GetStringSlice(key + "extra_args")
+		}
+
+		step_resources[step] = profile
+	}
+
+	return nil
+}
+
+func resourceSteps() []string {
+	var steps []string
+	for step := range default_resources {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+	return steps
+}
+
+// withResources sets the resources of the given step on a job
+func withResources(step string, j job) job {
+	profile, found := step_resources[step]
+	if !found {
+		profile = default_resources[step]
+	}
+
+	j.Memory = profile.Memory
+	j.Cores = profile.Cores
+	j.Walltime = profile.Walltime
+	j.Queue = profile.Queue
+	j.Extra_args = profile.Extra_args
+	return j
+}
+
+// stepCores is the number of threads the tools of a step should use
+func stepCores(step string) int {
+	if profile, found := step_resources[step]; found {
+		return profile.Cores
+	}
+	return default_resources[step].Cores
+}
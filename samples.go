@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"scVarCall/bam"
+
+	"github.com/spf13/viper"
+)
+
+// sample is one of the bams of a multi-sample run, with the cell list used to
+// subset it at step 4
+type sample struct {
+	ID       string
+	Input    string
+	Barcodes string
+}
+
+// sample_id is the sample being run in a multi-sample run, empty otherwise
+var sample_id string
+
+var sample_id_pattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// isAlignmentFile tells a bam or CRAM given with -i from a sample sheet
+func isAlignmentFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".bam", ".cram":
+		return true
+	}
+	_, err := bam.ReadHeaderFile(path)
+	return err == nil
+}
+
+// sampleIDFromPath names the sample of a bam after its file, or after the
+// CellRanger run it is in when it has the default name of CellRanger
+func sampleIDFromPath(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if name == "possorted_genome_bam" || name == "atac_possorted_bam" {
+		run_dir := filepath.Dir(path)
+		if filepath.Base(run_dir) == "outs" {
+			run_dir = filepath.Dir(run_dir)
+		}
+		name = filepath.Base(run_dir)
+	}
+	return name
+}
+
+// loadSampleSheet reads the samples of a TSV or CSV with the columns sample ID,
+// bam and, optionally, the cell list of the sample, which otherwise is the one
+// given with -b. A header line starting with "sample" is skipped.
+func loadSampleSheet(path string, barcodes string) ([]sample, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	table, err := newTableReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []sample
+	header := true
+	for {
+		row, err := table.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if header {
+			header = false
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(row[0])), "sample") {
+				continue
+			}
+		}
+		if len(row) == 1 && strings.TrimSpace(row[0]) == "" {
+			continue
+		}
+		if len(row) < 2 {
+			return nil, fmt.Errorf("line of %s should have a sample ID and a bam: %s", path, strings.Join(row, string(table.Comma)))
+		}
+
+		s := sample{ID: strings.TrimSpace(row[0]), Input: strings.TrimSpace(row[1]), Barcodes: barcodes}
+		if len(row) > 2 && strings.TrimSpace(row[2]) != "" {
+			s.Barcodes = strings.TrimSpace(row[2])
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// loadSamples gives the samples of a multi-sample run, from the bams given
+// to -i separated by commas or from a sample sheet, or nil when -i is a
+// single bam
+func loadSamples(input string, barcodes string) ([]sample, error) {
+	var samples []sample
+	if strings.Contains(input, ",") {
+		for _, path := range strings.Split(input, ",") {
+			path = strings.TrimSpace(path)
+			if path == "" {
+				continue
+			}
+			samples = append(samples, sample{ID: sampleIDFromPath(path), Input: path, Barcodes: barcodes})
+		}
+	} else if isAlignmentFile(input) {
+		return nil, nil
+	} else {
+		var err error
+		samples, err = loadSampleSheet(input, barcodes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the sample sheet %s: %w", input, err)
+		}
+	}
+
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("no samples in %s", input)
+	}
+	seen := make(map[string]bool)
+	for _, s := range samples {
+		if !sample_id_pattern.MatchString(s.ID) {
+			return nil, fmt.Errorf("sample ID '%s' of %s should only have letters, digits, dots, dashes and underscores", s.ID, s.Input)
+		}
+		if seen[s.ID] {
+			return nil, fmt.Errorf("sample ID %s is given to more than one bam, use a sample sheet to name them", s.ID)
+		}
+		seen[s.ID] = true
+	}
+	return samples, nil
+}
+
+// useSample points the globals of a run at the sample, so the steps run on it
+// in its own directory of the output directory
+func useSample(run_output_dir string, s sample) error {
+	sample_id = s.ID
+	input_bam = s.Input
+	barcodes_qc = s.Barcodes
+	output_dir = run_output_dir + s.ID + "/"
+	barcode_list = nil
+
+	var err error
+	mt_contig, err = findMTContig(input_bam)
+	if err != nil {
+		return err
+	}
+	log.Println(fmt.Sprintf("Using %s of %d bp as the mitochondrial contig of sample %s", mt_contig.Name, mt_contig.Length, s.ID))
+	return nil
+}
+
+// sampleCellsPath lists the cells of every sample with the rds tables they
+// were merged into, for mergeSampleRds.R
+func sampleCellsPath(run_output_dir string) string { return run_output_dir + "sample_cells.tsv" }
+
+func mergeCheckpointPath(run_output_dir string) string {
+	return run_output_dir + "checkpoint_merge.json"
+}
+
+// mergedRdsPaths are the calls and coverage of the cells of every sample
+func mergedRdsPaths(run_output_dir string) (string, string) {
+	return run_output_dir + "merged.calls.rds", run_output_dir + "merged.coverage.rds"
+}
+
+// writeSampleCells writes a line for every cell of a sample whose calls were
+// merged, naming it sample:barcode
+func writeSampleCells(w io.Writer, s sample, cells []barcode) int {
+	written := 0
+	for _, cell := range cells {
+		if !cell.Rdsmerge_success {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.ID, cellLabel(cell.Name), s.ID+":"+cell.Name, cell.Rdsmerge_rds_calls, cell.Rdsmerge_rds_coverage)
+		written++
+	}
+	return written
+}
+
+func sampleMergeJob(run_output_dir string) job {
+	merged_calls, merged_coverage := mergedRdsPaths(run_output_dir)
+	return withResources("sample_merge", job{
+		Name:   "sample_merge",
+		Stdout: run_output_dir + "sample_merge.o",
+		Stderr: run_output_dir + "sample_merge.e",
+		Command: []string{
+			Rscript_exec, "mergeSampleRds.R",
+			sampleCellsPath(run_output_dir), merged_calls, merged_coverage},
+	})
+}
+
+// mergeSamples merges the calls of the cells of every sample into a single
+// pair of rds tables, their columns named sample:barcode
+func mergeSamples(run_output_dir string, samples []sample, sample_cells map[string][]barcode) error {
+	if fileExists(mergeCheckpointPath(run_output_dir)) {
+		log.Println("Checkpoint exists for the merge of the samples, loading progress")
+		return nil
+	}
+
+	cells_file, err := os.Create(sampleCellsPath(run_output_dir))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cells_file, "Sample\tLabel\tCell\tCalls\tCoverage\n")
+	for _, s := range samples {
+		written := writeSampleCells(cells_file, s, sample_cells[s.ID])
+		log.Println(fmt.Sprintf("Merging the calls of %d cells of sample %s", written, s.ID))
+	}
+	err = cells_file.Close()
+	if err != nil {
+		return err
+	}
+
+	merge := barcode{Name: "MERGE", Output_dir: run_output_dir}
+	err = runJob(sampleMergeJob(run_output_dir), &merge)
+	if err != nil {
+		return err
+	}
+	merge.Rdsmerge_rds_calls, merge.Rdsmerge_rds_coverage = mergedRdsPaths(run_output_dir)
+	merge.Rdsmerge_success = true
+
+	// the variants informative across the cells of every sample, and the
+	// heteroplasmy of their calls
+	err = selectCellVariants([]barcode{merge}, run_output_dir, &merge)
+	if err != nil {
+		return err
+	}
+	err = estimateCellHeteroplasmy([]barcode{merge}, run_output_dir, &merge)
+	if err != nil {
+		return err
+	}
+
+	merge_json, _ := json.MarshalIndent(merge, "", "  ")
+	err = ioutil.WriteFile(mergeCheckpointPath(run_output_dir), merge_json, 0644)
+	if err != nil {
+		return err
+	}
+	log.Println("Checkpoint saved for the merge of the samples")
+	return nil
+}
+
+// runSamples runs the steps of the pipeline on every sample in turn, then
+// merges their calls once all of them are done. A sample that fails doesn't
+// stop the others, but the merge waits for a run where they all succeed.
+// Returns false if a sample or the merge failed
+func runSamples(samples []sample, dry_run bool, plan_as_json bool) bool {
+	run_output_dir := output_dir
+
+	if dry_run {
+		plan := multiSamplePlan{Output_dir: run_output_dir, Executor: viper.GetString("executor")}
+		for _, s := range samples {
+			err := useSample(run_output_dir, s)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			sample_plan := buildPlan()
+			sample_plan.Sample = s.ID
+			plan.Samples = append(plan.Samples, sample_plan)
+		}
+		output_dir = run_output_dir
+		plan.Merge = planSampleMerge(run_output_dir)
+		if plan_as_json {
+			if err := plan.writeJSON(os.Stdout); err != nil {
+				log.Fatalln(err)
+			}
+		} else {
+			plan.write(os.Stdout)
+		}
+		return true
+	}
+
+	err := os.MkdirAll(run_output_dir, 0755)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	handleInterrupts()
+
+	sample_cells := make(map[string][]barcode)
+	var failed []string
+	for _, s := range samples {
+		log.Println(fmt.Sprintf("Running sample %s from %s", s.ID, s.Input))
+		err := useSample(run_output_dir, s)
+		if err != nil {
+			log.Println(err)
+			failed = append(failed, s.ID)
+			continue
+		}
+		if !runSteps() {
+			failed = append(failed, s.ID)
+			continue
+		}
+		sample_cells[s.ID] = barcode_list[1:]
+	}
+	sample_id = ""
+	output_dir = run_output_dir
+
+	if len(failed) > 0 {
+		log.Println(fmt.Sprintf("Samples %s failed, the calls of the samples are merged once they all succeed, rerun the same command to resume them", strings.Join(failed, ", ")))
+		return false
+	}
+	err = mergeSamples(run_output_dir, samples, sample_cells)
+	if err != nil {
+		log.Println(fmt.Sprintf("Error when merging the samples: %s", err))
+		return false
+	}
+	return true
+}
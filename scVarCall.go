@@ -1,18 +1,15 @@
 package main
 
 import (
-	"bufio"
-	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"reflect"
-	"regexp"
-	"strconv"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -75,8 +72,7 @@ func stringInSlice(a string, list []string) bool {
 }
 
 func writeCheckpoint(barcode_list []barcode, step int) {
-	checkpoint_file := fmt.Sprintf("checkpoint_%d.json", step)
-	checkpoint_file = output_dir + checkpoint_file
+	checkpoint_file := checkpointPath(step)
 	rankingsJson, _ := json.MarshalIndent(barcode_list, "", "  ")
 	err := ioutil.WriteFile(checkpoint_file, rankingsJson, 0644)
 	if err != nil {
@@ -85,47 +81,92 @@ func writeCheckpoint(barcode_list []barcode, step int) {
 	log.Println(fmt.Sprintf("Checkpoint saved for step %d", step))
 }
 
-func bjobsIsCompleted(
-	submitted_jobs_map map[string]string,
+// runSteps goes through the steps of the pipeline that don't have a checkpoint
+// yet, returning false if one of them failed
+func runSteps() bool {
+	for i, step := range pipeline_steps {
+		current_step := i + 1
+		// if the step was completed by a previous run then skip to next step
+		if loadCheckpoint(current_step) {
+			continue
+		}
+		if wasInterrupted() {
+			log.Println(fmt.Sprintf("Interrupted before step %d, rerun the same command to resume", current_step))
+			os.Exit(1)
+		}
+		loadPartialCheckpoint(current_step)
+
+		log.Println(fmt.Sprintf("Starting step %d", current_step))
+		err := step.run()
+		if errors.Is(err, errInterrupted) {
+			// save how far the step got, with the state of every cell, so it can be resumed
+			writePartialCheckpoint(barcode_list, current_step)
+			log.Println(fmt.Sprintf("Interrupted during step %d, rerun the same command to resume", current_step))
+			os.Exit(1)
+		}
+		if err != nil {
+			// keep the cells that were done so a rerun doesn't start them over
+			writePartialCheckpoint(barcode_list, current_step)
+			log.Println(fmt.Sprintf("Error when running step %d: %s", current_step, err))
+			return false
+		}
+		writeCheckpoint(barcode_list, current_step)
+		rmIfExists(partialCheckpointPath(current_step))
+	}
+	return true
+}
+
+// jobsAreCompleted submits every job in submitted_jobs_map (barcode name to
+// job) and waits for them to finish, retrying failed ones as configured. Jobs
+// are recorded under step on their barcode and attribute_name is set on the
+// barcode of those that succeeded. Returns errInterrupted if the pipeline was
+// interrupted before all of them finished.
+func jobsAreCompleted(
+	submitted_jobs_map map[string]job,
+	step string,
 	attribute_name string,
 	barcode_list *[]barcode,
 	remove_list []string,
-) {
-	// while there are still jobs in submitted_jobs_map, iterate over reading through all job outputs and only leave when all have completed successfully
-	for len(submitted_jobs_map) > 0 {
-		for i := range *barcode_list {
-			func_cram := &((*barcode_list)[i])
-			bjobs_output_filename := submitted_jobs_map[func_cram.Name]
-
-			dat, err := ioutil.ReadFile(bjobs_output_filename)
-			if err == nil {
-				// when job has finished (either successfully or with exit code, remove from the waiting list 'submitted_jobs_map'
-				if strings.Contains(string(dat), "Terminated at") {
-					delete(submitted_jobs_map, func_cram.Name)
-
-					// if job has finished and successfully completed then set the specified attribute_name to true
-					if strings.Contains(string(dat), "Successfully completed.") {
-						reflect.ValueOf(func_cram).Elem().FieldByName(attribute_name).SetBool(true)
-
-						if len(remove_list) > 0 {
-							for _, file := range remove_list {
-								filename_path := reflect.ValueOf(func_cram).Elem().FieldByName(file).Interface().(string)
-								err := os.Remove(filename_path)
-								if err != nil {
-									log.Fatal(err)
-								}
-							}
-						}
-
-					} else {
-						log.Println(fmt.Sprintf("Error with bsub job: %s", bjobs_output_filename))
-					}
+) error {
+	cells := make(map[string]*barcode)
+	for i := range *barcode_list {
+		func_cram := &((*barcode_list)[i])
+		if _, submitted := submitted_jobs_map[func_cram.Name]; submitted {
+			cells[func_cram.Name] = func_cram
+		}
+	}
+
+	tracker := newRetryingJobTracker()
+	for name, j := range submitted_jobs_map {
+		tracker.enqueue(name, j)
+	}
+
+	// when job has finished (either successfully, with exit code, timed out or lost, remove from the waiting list 'submitted_jobs_map'
+	return tracker.waitAll(func(name string, record jobRecord) {
+		delete(submitted_jobs_map, name)
+
+		func_cram, found := cells[name]
+		if !found {
+			return
+		}
+		func_cram.recordJob(step, record)
+
+		// if job has finished and successfully completed then set the specified attribute_name to true
+		if record.State == jobDone {
+			reflect.ValueOf(func_cram).Elem().FieldByName(attribute_name).SetBool(true)
+
+			for _, file := range remove_list {
+				filename_path := reflect.ValueOf(func_cram).Elem().FieldByName(file).Interface().(string)
+				err := os.Remove(filename_path)
+				if err != nil && !os.IsNotExist(err) {
+					log.Println(fmt.Sprintf("Unable to remove intermediate file: %s", err))
 				}
 			}
+
+		} else if record.State != jobCancelled {
+			log.Println(fmt.Sprintf("Error with job %s for %s: %s, exit code %d", record.Job_id, name, record.State, record.Exit_code))
 		}
-		// sleep for 5 seconds after going through every job's output before retrying
-		time.Sleep(5 * time.Second)
-	}
+	})
 }
 
 //func quickcheck_alignments(barcode_list []barcode, i int, samtools_exec string) {
@@ -146,32 +187,48 @@ func bjobsIsCompleted(
 //	wg.Done()
 //}
 
-func indexBam(bam_filename string) {
-	output, err := exec.Command(samtools_exec, "index", bam_filename).CombinedOutput()
+func indexBam(bam_filename string, owner *barcode) bool {
+	err := runJob(indexJob(bam_filename), owner)
 
 	if err != nil {
-		// Display everything we got if error.
-		log.Println("Error when running command.  Output:")
-		log.Println(string(output))
-		log.Printf("Got command status: %s\n", err.Error())
+		log.Printf("Error when indexing %s: %s\n", bam_filename, err.Error())
+		return false
 	}
+	return true
+}
+
+func quickcheckBam(bam_filename string, owner *barcode) bool {
+	err := runJob(quickcheckJob(bam_filename), owner)
+
+	if err != nil {
+		log.Printf("Quickcheck failed for %s: %s\n", bam_filename, err.Error())
+		return false
+	}
+	return true
 }
 
 type barcode struct {
 	Name                                     string
 	Output_dir                               string
 	Masterbam_original                       string
+	Masterbam_sample                         string `json:",omitempty"`
 	Masterbam_original_quickcheck_success    bool
+	Masterbam_MT_contig                      string
+	Masterbam_MT_length                      int
 	Masterbam_MT_subset                      string
 	Masterbam_MT_subset_quickcheck_success   bool
 	Masterbam_MT_subset_index_success        bool
 	Masterbam_QC_subset                      string
+	Masterbam_QC_whitelisted                 int
+	Masterbam_QC_whitelisted_found           int
 	Masterbam_QC_subset_quickcheck_success   bool
 	Masterbam_QC_subset_index_success        bool
 	Masterbam_UMI_deduped                    string
 	Masterbam_UMI_deduped_success            bool
 	Masterbam_UMI_deduped_quickcheck_success bool
 	Masterbam_UMI_deduped_index_success      bool
+	Masterbam_UMI_dedup_stats                map[string]dedupStats `json:",omitempty"`
+	Masterbam_read_filters                   *readFilters          `json:",omitempty"`
 	Splitbam_jobout                          string
 	Splitbam_joberr                          string
 	Splitbam_bamout                          string
@@ -179,6 +236,13 @@ type barcode struct {
 	Splitbam_barcodefile                     string
 	Splitbam_successful                      bool
 	Splitbam_indexed                         bool
+	Splitbam_index_jobout                    string
+	Splitbam_index_joberr                    string
+	Gem_well                                 string `json:",omitempty"`
+	Celltask_manifest                        string
+	Celltask_index                           int
+	Celltask_jobout                          string
+	Celltask_joberr                          string
 	Rvarcall_jobout                          string
 	Rvarcall_joberr                          string
 	Rvarcall_dir_out                         string
@@ -188,10 +252,14 @@ type barcode struct {
 	Rdsmerge_rds_calls                       string
 	Rdsmerge_rds_coverage                    string
 	Rdsmerge_success                         bool
+	Variants_ranked                          string      `json:",omitempty"`
+	Variants_informative                     int         `json:",omitempty"`
+	Heteroplasmy_estimates                   string      `json:",omitempty"`
+	Umi_family_sizes                         map[int]int `json:",omitempty"`
+	Jobs                                     map[string]jobRecord
 }
 
 var barcode_list []barcode
-var chunk_cell_map map[string]string
 
 var output_dir string
 var samtools_exec string
@@ -209,6 +277,63 @@ func main() {
 	viper.SetDefault("samtools_exec", "/software/sciops/pkgg/samtools/1.10.0/bin/samtools")
 	viper.SetDefault("Rscript_exec", "/software/R-4.1.0/bin/Rscript")
 	viper.SetDefault("umitools_exec", "/software/teamtrynka/conda/trynka-base/bin/umi_tools")
+	viper.SetDefault("executor", "lsf")
+	viper.SetDefault("bsub_exec", "bsub")
+	viper.SetDefault("bjobs_exec", "bjobs")
+	viper.SetDefault("bkill_exec", "bkill")
+	viper.SetDefault("sbatch_exec", "sbatch")
+	viper.SetDefault("sacct_exec", "sacct")
+	viper.SetDefault("scancel_exec", "scancel")
+	viper.SetDefault("local_max_jobs", runtime.NumCPU())
+	viper.SetDefault("job_timeout", "0")
+	viper.SetDefault("global_timeout", "0")
+	viper.SetDefault("lost_job_timeout", "30m")
+	viper.SetDefault("retry.max_retries", 2)
+	viper.SetDefault("retry.backoff", "1m")
+	viper.SetDefault("retry.memory_factor", 2.0)
+	viper.SetDefault("retry.walltime_factor", 2.0)
+	viper.SetDefault("job_arrays", true)
+	viper.SetDefault("bam_engine", "samtools")
+	viper.SetDefault("varcall_engine", "native")
+	viper.SetDefault("dedup_engine", "umi_tools")
+	viper.SetDefault("dedup_method", "directional")
+	viper.SetDefault("dedup_edit_distance", 1)
+	viper.SetDefault("reference_fasta", "")
+	viper.SetDefault("barcode_column", "1")
+	viper.SetDefault("barcode_pattern", `^([ACGTN]+)(?:-([0-9]+))?$`)
+	viper.SetDefault("mt_contig_aliases", []string{"MT", "chrM", "chrMT", "M"})
+	viper.SetDefault("consensus.enabled", false)
+	viper.SetDefault("consensus.min_family_size", 2)
+	viper.SetDefault("consensus.min_agreement", 0.8)
+	viper.SetDefault("read_filters.min_base_quality", 24)
+	viper.SetDefault("read_filters.min_mapping_quality", 24)
+	viper.SetDefault("read_filters.required_flags", 0)
+	viper.SetDefault("read_filters.excluded_flags", 0) // no mask, like bam2R
+	viper.SetDefault("read_filters.min_distance_from_end", 0)
+	viper.SetDefault("read_filters.max_soft_clip", -1)
+	viper.SetDefault("read_filters.max_mismatches", -1)
+	viper.SetDefault("read_filters.proper_pair", false)
+	viper.SetDefault("read_filters.excluded_tags", []string{})
+	viper.SetDefault("strand_filter.enabled", false)
+	viper.SetDefault("strand_filter.min_correlation", 0.65)
+	viper.SetDefault("strand_filter.min_cells", 2)
+	viper.SetDefault("variant_selection.enabled", false)
+	viper.SetDefault("variant_selection.min_coverage", 10)
+	viper.SetDefault("variant_selection.min_heteroplasmy", 0.1)
+	viper.SetDefault("variant_selection.min_cells", 2)
+	viper.SetDefault("variant_selection.min_vmr", 0.01)
+	viper.SetDefault("variant_selection.max_mean_af", 0.9)
+	viper.SetDefault("variant_selection.min_strand_correlation", 0.65)
+	viper.SetDefault("heteroplasmy.enabled", false)
+	viper.SetDefault("heteroplasmy.model", "binomial")
+	viper.SetDefault("heteroplasmy.overdispersion", 0.01)
+	viper.SetDefault("heteroplasmy.prior_alpha", 0.5)
+	viper.SetDefault("heteroplasmy.prior_beta", 0.5)
+	viper.SetDefault("heteroplasmy.error_rate", 0.005)
+	viper.SetDefault("heteroplasmy.prior_present", 0.5)
+	viper.SetDefault("heteroplasmy.credible_level", 0.95)
+	viper.SetDefault("heteroplasmy.min_coverage", 20)
+	viper.SetDefault("heteroplasmy.min_posterior", 0.95)
 	viper.SetDefault(
 		"star_exec",
 		"/nfs/users/nfs_r/rr11/Tools/STAR-2.5.2a/bin/Linux_x86_64_static/STAR",
@@ -223,517 +348,137 @@ func main() {
 	)
 
 	// read in config file if found, else use defaults
-	//if err := viper.ReadInConfig(); err != nil {
-	//	log.Fatalln("Unable to read config file")
-	//}
+	if err := viper.ReadInConfig(); err != nil {
+		if _, not_found := err.(viper.ConfigFileNotFoundError); !not_found {
+			log.Fatalln(fmt.Sprintf("Unable to read config file: %s", err))
+		}
+	}
 
 	samtools_exec = viper.GetString("samtools_exec")
 	Rscript_exec = viper.GetString("Rscript_exec")
-	umitools_exec := viper.GetString("umitools_exec")
+	umitools_exec = viper.GetString("umitools_exec")
 	//star_exec := viper.GetString("star_exec")
 	//star_genome_dir := viper.GetString("star_genome_dir")
 	//featurecounts_exec := viper.GetString("featurecounts_exec")
 	//genome_annot := viper.GetString("genome_annot")
 
-	var input string
-	var barcodes_qc string
-	var threads string
-	var current_step int
+	var err error
+	job_executor, err = newExecutor(viper.GetString("executor"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := loadResources(); err != nil {
+		log.Fatalln(fmt.Sprintf("Invalid resources in config: %s", err))
+	}
+	if bam_engine := viper.GetString("bam_engine"); bam_engine != "native" && bam_engine != "samtools" {
+		log.Fatalln(fmt.Sprintf("Unknown bam_engine '%s', expected native or samtools", bam_engine))
+	}
+	if varcall_engine := viper.GetString("varcall_engine"); varcall_engine != "native" && varcall_engine != "callvars" {
+		log.Fatalln(fmt.Sprintf("Unknown varcall_engine '%s', expected native or callvars", varcall_engine))
+	}
+	if dedup_engine := viper.GetString("dedup_engine"); dedup_engine != "native" && dedup_engine != "umi_tools" {
+		log.Fatalln(fmt.Sprintf("Unknown dedup_engine '%s', expected native or umi_tools", dedup_engine))
+	}
+	if viper.GetBool("consensus.enabled") && viper.GetString("varcall_engine") != "native" {
+		log.Fatalln("consensus needs varcall_engine: native")
+	}
+	if consensus := consensusFromConfig(); consensus != nil && (consensus.min_family_size < 1 || consensus.min_agreement <= 0 || consensus.min_agreement > 1) {
+		log.Fatalln("consensus.min_family_size should be at least 1 and consensus.min_agreement between 0 and 1")
+	}
+	if viper.GetBool("strand_filter.enabled") && viper.GetString("varcall_engine") != "native" {
+		log.Fatalln("strand_filter needs varcall_engine: native")
+	}
+	if strand := strandFilterFromConfig(); strand != nil && (strand.min_correlation < -1 || strand.min_correlation > 1 || strand.min_cells < 2) {
+		log.Fatalln("strand_filter.min_correlation should be between -1 and 1 and strand_filter.min_cells at least 2")
+	}
+	if selection := variantSelectionFromConfig(); selection != nil && !selection.valid() {
+		log.Fatalln("variant_selection.min_coverage and min_cells should be at least 1, min_heteroplasmy and max_mean_af between 0 and 1, min_vmr 0 or more and min_strand_correlation between -1 and 1")
+	}
+	if model := heteroplasmyModelFromConfig(); model != nil {
+		if err := model.check(); err != nil {
+			log.Fatalln(fmt.Sprintf("Invalid heteroplasmy in config: %s", err))
+		}
+	}
+	if dedup_method := viper.GetString("dedup_method"); dedup_method != "directional" && dedup_method != "unique" {
+		log.Fatalln(fmt.Sprintf("Unknown dedup_method '%s', expected directional or unique", dedup_method))
+	}
+	read_filters, err = readFiltersFromConfig()
+	if err != nil {
+		log.Fatalln(fmt.Sprintf("Invalid read_filters in config: %s", err))
+	}
+	if unsupported := read_filters.unsupportedByCallVars(); len(unsupported) > 0 && viper.GetString("varcall_engine") == "callvars" {
+		log.Println(fmt.Sprintf("callVars.R can't apply these read filters, use varcall_engine: native to apply them: %s", strings.Join(unsupported, ", ")))
+	}
+	if err := loadBarcodePattern(); err != nil {
+		log.Fatalln(fmt.Sprintf("Invalid barcode_pattern in config: %s", err))
+	}
+	if global_timeout := viper.GetDuration("global_timeout"); global_timeout > 0 {
+		pipeline_deadline = time.Now().Add(global_timeout)
+	}
+
+	var dry_run bool
+	var plan_as_json bool
 
 	// flags declaration using flag package
-	flag.StringVar(&input, "i", "input", "input bam file produced by 10X CellRanger")
+	flag.StringVar(&input_bam, "i", "input", "input bam file produced by 10X CellRanger, several of them separated by commas, or a sample sheet of sample IDs and bams")
 	flag.StringVar(&output_dir, "o", "output", "path to output directory")
-	flag.StringVar(&barcodes_qc, "b", "barcodes", "list of QC passed barcodes")
+	flag.StringVar(&barcodes_qc, "b", "barcodes", "list of QC passed barcodes, as a plain list, TSV or CSV, gzipped or not")
+	flag.BoolVar(&dry_run, "dry-run", false, "print the jobs that would be run without submitting or creating anything")
+	flag.BoolVar(&plan_as_json, "json", false, "print the dry run plan as JSON")
 
 	flag.Parse() // after declaring flags we need to call it
-	if (strings.TrimSpace(input) == "input") || (strings.TrimSpace(output_dir) == "output_dir") {
+	if (strings.TrimSpace(input_bam) == "input") || (strings.TrimSpace(output_dir) == "output_dir") {
 		log.Fatalln("No input or output_dir argument was provided")
 	}
 	// make sure output dir ends in slash so paths work correctly when appending filenames
 	output_dir = output_dir + "/"
 
-	mt_subset_bam := output_dir + "/MT_subset.bam"
-	threads = "4"
-
-	current_step = 1
-	if fileExists(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &barcode_list)
-		if err != nil {
-			panic(err)
-		}
-
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
-
-	} else {
-		log.Println(fmt.Sprintf("Starting step %d", current_step))
-
-		log.Println("Defining input and output paths for master bam")
-		err := os.Mkdir(output_dir, 0755)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// define a "master" barcode for the bam file that is to be split
-		// this isnt a barcode per se, but the origin of the barcodes
-		var master_barcode barcode
-		master_barcode.Name = "MASTER"
-		master_barcode.Output_dir = output_dir
-		master_barcode.Masterbam_original = input
-
-		barcode_list = append(barcode_list, master_barcode)
-		writeCheckpoint(barcode_list, current_step)
-	}
-
-	current_step = 2
-	// if bam has been subset to MT already then skip to next step
-	if fileExists(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &barcode_list)
-		if err != nil {
-			panic(err)
-		}
-
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
-
-	} else {
-		log.Println(fmt.Sprintf("Starting step %d", current_step))
-
-		master_barcode := &barcode_list[0]
-
-		log.Println("Quickchecking input bam file")
-
-		output, err := exec.Command(samtools_exec, "quickcheck", master_barcode.Masterbam_original).CombinedOutput()
-
-		if err != nil {
-			// Display everything we got if error.
-			log.Println("Error when running command.  Output:")
-			log.Println(string(output))
-			log.Printf("Got command status: %s\n", err.Error())
-			master_barcode.Masterbam_original_quickcheck_success = false
-		} else {
-			master_barcode.Masterbam_original_quickcheck_success = true
-		}
-
-		log.Println("Subsetting bam file to MT only")
-
-		output, err = exec.Command(
-			"bsub",
-			"-I",
-			"-R'select[mem>50000] rusage[mem=50000]'", "-M50000",
-			"-n", threads,
-			samtools_exec, "view",
-			input, "MT",
-			"-b", "-@", threads,
-			">", mt_subset_bam).CombinedOutput()
-
-		if err != nil {
-			// Display everything we got if error.
-			log.Println("Error when running command.  Output:")
-			log.Println(string(output))
-			log.Printf("Got command status: %s\n", err.Error())
-			return
-		}
-
-		master_barcode.Masterbam_MT_subset = mt_subset_bam
-
-		log.Println("Quickchecking subset bam file")
-
-		output, err = exec.Command(samtools_exec, "quickcheck", master_barcode.Masterbam_MT_subset).CombinedOutput()
-
-		if err != nil {
-			// Display everything we got if error.
-			log.Println("Error when running command.  Output:")
-			log.Println(string(output))
-			log.Printf("Got command status: %s\n", err.Error())
-			master_barcode.Masterbam_MT_subset_quickcheck_success = false
-		} else {
-			master_barcode.Masterbam_MT_subset_quickcheck_success = true
-		}
-
-		writeCheckpoint(barcode_list, current_step)
-	}
-
-	current_step = 3
-	if fileExists(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &barcode_list)
-		if err != nil {
-			panic(err)
-		}
-
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
-
-	} else {
-		log.Println(fmt.Sprintf("Starting step %d", current_step))
-
-		log.Println("Indexing newly created MT subset bam")
-
-		indexBam((&barcode_list[0]).Masterbam_MT_subset)
-		(&barcode_list[0]).Masterbam_MT_subset_index_success = true
-
-		writeCheckpoint(barcode_list, current_step)
+	samples, err := loadSamples(input_bam, barcodes_qc)
+	if err != nil {
+		log.Fatalln(err)
 	}
-
-	current_step = 4
-	if fileExists(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &barcode_list)
-		if err != nil {
-			panic(err)
-		}
-
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
-
-	} else {
-		log.Println(fmt.Sprintf("Starting step %d", current_step))
-
-		log.Println("Subsetting to QC passed barcodes")
-		(&barcode_list[0]).Masterbam_QC_subset = output_dir + "/MT_subset_QC_filtered.bam"
-
-		output, err := exec.Command(
-			"bsub",
-			"-I",
-			"-R'select[mem>5000] rusage[mem=5000]'", "-M5000",
-			"-n", "12",
-			"subset-bam", "--cores", "12",
-			"--bam", (&barcode_list[0]).Masterbam_MT_subset,
-			"--cell-barcodes", barcodes_qc,
-			"--out-bam", (&barcode_list[0]).Masterbam_QC_subset).CombinedOutput()
-
-		if err != nil {
-			// Display everything we got if error.
-			log.Println("Error when running command.  Output:")
-			log.Println(string(output))
-			log.Printf("Got command status: %s\n", err.Error())
-			return
-		}
-
-		output, err = exec.Command(samtools_exec, "quickcheck", (&barcode_list[0]).Masterbam_QC_subset).CombinedOutput()
-
-		if err != nil {
-			// Display everything we got if error.
-			log.Println("Error when running command.  Output:")
-			log.Println(string(output))
-			log.Printf("Got command status: %s\n", err.Error())
-			(&barcode_list[0]).Masterbam_QC_subset_quickcheck_success = false
-		} else {
-			(&barcode_list[0]).Masterbam_QC_subset_quickcheck_success = true
+	inputs := []string{input_bam}
+	if samples != nil {
+		inputs = nil
+		for _, s := range samples {
+			inputs = append(inputs, s.Input)
 		}
-
-		indexBam((&barcode_list[0]).Masterbam_QC_subset)
-		(&barcode_list[0]).Masterbam_QC_subset_index_success = true
-
-		writeCheckpoint(barcode_list, current_step)
 	}
-
-	current_step = 5
-	if fileExists(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &barcode_list)
-		if err != nil {
-			panic(err)
-		}
-
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
-
-	} else {
-		log.Println(fmt.Sprintf("Starting step %d", current_step))
-
-		log.Println("Deduplicating UMIs")
-		deduped_bam := output_dir + "/MT_subset_umi_deduped.bam"
-		(&barcode_list[0]).Masterbam_UMI_deduped = deduped_bam
-
-		output, err := exec.Command(
-			"bsub",
-			"-I",
-			"-R'select[mem>80000] rusage[mem=80000]'", "-M80000",
-			umitools_exec, "dedup",
-			"--paired",
-			"--chrom", "MT",
-			"--extract-umi-method", "tag",
-			"--umi-tag", "UB",
-			"--per-cell", "--cell-tag", "CB",
-			"-I", (&barcode_list[0]).Masterbam_QC_subset,
-			"-S", (&barcode_list[0]).Masterbam_UMI_deduped).CombinedOutput()
-
-		if err != nil {
-			// Display everything we got if error.
-			log.Println("Error when running command.  Output:")
-			log.Println(string(output))
-			log.Printf("Got command status: %s\n", err.Error())
-			return
+	for _, input := range inputs {
+		if isCram(input) && viper.GetString("reference_fasta") == "" {
+			log.Fatalln(fmt.Sprintf("%s is a CRAM file, reference_fasta needs to be set in the config to decode it", input))
 		}
-
-		(&barcode_list[0]).Masterbam_UMI_deduped_success = true
-
-		// quickcheck produced bam
-		output, err = exec.Command(samtools_exec, "quickcheck", (&barcode_list[0]).Masterbam_UMI_deduped).CombinedOutput()
-
-		if err != nil {
-			// Display everything we got if error.
-			log.Println("Error when running command.  Output:")
-			log.Println(string(output))
-			log.Printf("Got command status: %s\n", err.Error())
-			(&barcode_list[0]).Masterbam_UMI_deduped_quickcheck_success = false
-		} else {
-			(&barcode_list[0]).Masterbam_UMI_deduped_quickcheck_success = true
-		}
-
-		writeCheckpoint(barcode_list, current_step)
 	}
 
-	current_step = 6
-	if fileExists(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &barcode_list)
-		if err != nil {
-			panic(err)
+	if samples != nil {
+		if !runSamples(samples, dry_run, plan_as_json) {
+			os.Exit(1)
 		}
-
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
-
-	} else {
-		log.Println(fmt.Sprintf("Starting step %d", current_step))
-
-		log.Println("Indexing newly created deduped bam")
-
-		indexBam((&barcode_list[0]).Masterbam_UMI_deduped)
-		(&barcode_list[0]).Masterbam_UMI_deduped_index_success = true
-
-		writeCheckpoint(barcode_list, current_step)
+		return
 	}
 
-	current_step = 7
-	if fileExists(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &barcode_list)
-		if err != nil {
-			panic(err)
-		}
-
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
-
-	} else {
-		log.Println(fmt.Sprintf("Starting step %d", current_step))
-		log.Println("Reading barcodes in deduped and subset bam input")
-		output, err := exec.Command(
-			"bsub",
-			"-I",
-			"-R'select[mem>50000] rusage[mem=50000]'", "-M50000",
-			"-n", threads,
-			samtools_exec, "view", (&barcode_list[0]).Masterbam_UMI_deduped,
-			"|", "grep", "-oE", "CB:Z:[acgtnACGTN-]+[1-9]",
-			"|", "sort", "-u", "--parallel", threads,
-			"|", "gzip", ">", output_dir+"unique_barcodes.tsv.gz").CombinedOutput()
-
-		if err != nil {
-			// Display everything we got if error.
-			log.Println("Error when running command.  Output:")
-			log.Println(string(output))
-			log.Printf("Got command status: %s\n", err.Error())
-			return
-		}
-
-		writeCheckpoint(barcode_list, current_step)
+	mt_contig, err = findMTContig(input_bam)
+	if err != nil {
+		log.Fatalln(err)
 	}
+	log.Println(fmt.Sprintf("Using %s of %d bp as the mitochondrial contig", mt_contig.Name, mt_contig.Length))
 
-	current_step = 8
-	if fileExists(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(output_dir + fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &barcode_list)
-		if err != nil {
-			panic(err)
-		}
-
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
-
-	} else {
-		log.Println(fmt.Sprintf("Starting step %d", current_step))
-
-		//log.Println("Parsing unique barcodes file into memory")
-		barcodefile, err := os.Open(output_dir + "unique_barcodes.tsv.gz")
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer barcodefile.Close()
-
-		gr, err := gzip.NewReader(barcodefile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer gr.Close()
-
-		barcodefile_scanner := bufio.NewScanner(gr)
-		for barcodefile_scanner.Scan() {
-			// remove 'CB:Z:' prefix to get just the cell barcode
-			leading_regex := regexp.MustCompile(`^CB:Z:`)
-			barcode_str := leading_regex.ReplaceAllString(barcodefile_scanner.Text(), "")
-
-			if len(barcode_str) != 18 {
-				log.Println("Problem with barcode parsed from: " + barcodefile_scanner.Text())
-				log.Fatalln(fmt.Sprintf("Barcode '%s' is not of expected length, should be 18bp (with -1 ending) but is %d", barcode_str, len(barcode_str)))
+	if dry_run {
+		plan := buildPlan()
+		if plan_as_json {
+			if err := plan.writeJSON(os.Stdout); err != nil {
+				log.Fatalln(err)
 			}
-
-			new_barcode := barcode{Name: barcode_str}
-
-			barcode_list = append(barcode_list, new_barcode)
+		} else {
+			plan.write(os.Stdout)
 		}
+		return
+	}
 
-		// chunk the list of barcodes into groups of 500
-		chunked_barcode_list := chunkSlice(barcode_list[1:], 500)
-
-		log.Println("Spliting and calling variants on chunks of 500 barcodes")
-		for chunk_i, chunk := range chunked_barcode_list {
-
-			chunk_cell_map = make(map[string]string)
-			chunk_output := output_dir + "/chunk_" + strconv.Itoa(chunk_i) + "/"
-			err := os.Mkdir(chunk_output, 0755)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			for i := range chunk {
-				cell := &chunk[i]
-
-				cell.Splitbam_jobout = chunk_output + "cellsplit_" + cell.Name + ".o"
-				cell.Splitbam_joberr = chunk_output + "cellsplit_" + cell.Name + ".e"
-				cell.Splitbam_bamout = chunk_output + "cell_" + cell.Name + ".bam"
-				cell.Splitbam_bamindex = cell.Splitbam_bamout + ".bai"
-				cell.Splitbam_barcodefile = chunk_output + "barcode_" + cell.Name + ".txt"
-
-				// write a file with barcode inside for splitbam
-				job_barcode_out, err := os.Create(cell.Splitbam_barcodefile)
-				if err != nil {
-					log.Fatal(err)
-				}
-				defer job_barcode_out.Close()
-				_, err = job_barcode_out.WriteString(cell.Name + "\n")
-
-				// add this barcode to list of current jobs
-				chunk_cell_map[cell.Name] = cell.Splitbam_jobout
-
-				// split bam to current barcode
-				output, err := exec.Command(
-					"bsub",
-					"-o", cell.Splitbam_jobout,
-					"-e", cell.Splitbam_joberr,
-					"-R'select[mem>5000] rusage[mem=5000]'", "-M5000",
-					"-n", "12",
-					"subset-bam", "--cores", "12",
-					"--bam", (&barcode_list[0]).Masterbam_UMI_deduped,
-					"--cell-barcodes", cell.Splitbam_barcodefile,
-					"--out-bam", cell.Splitbam_bamout).CombinedOutput()
-
-				if err != nil {
-					// Display everything we got if error.
-					log.Println("Error when running command.  Output:")
-					log.Println(string(output))
-					log.Printf("Got command status: %s\n", err.Error())
-					return
-				}
-			}
-
-			// wait for that chunks splits to finish
-			bjobsIsCompleted(chunk_cell_map, "Splitbam_successful", &barcode_list, []string{"Splitbam_jobout", "Splitbam_joberr", "Splitbam_barcodefile"})
-
-			// index the split bam files
-			for i := range chunk {
-				cell := &chunk[i]
-				if cell.Splitbam_successful {
-					indexBam(cell.Splitbam_bamout)
-					cell.Splitbam_indexed = true
-				}
-			}
-
-			// run variant calling on the bam files
-			for i := range chunk {
-				cell := &chunk[i]
-				if cell.Splitbam_indexed {
-
-					cell.Rvarcall_jobout = chunk_output + "Rvarcall_" + cell.Name + ".o"
-					cell.Rvarcall_joberr = chunk_output + "Rvarcall_" + cell.Name + ".e"
-					cell.Rvarcall_dir_out = chunk_output
-
-					// add this barcode to list of current jobs
-					chunk_cell_map[cell.Name] = cell.Rvarcall_jobout
-
-					// call variants on bam
-					output, err := exec.Command(
-						"bsub",
-						"-o", cell.Rvarcall_jobout,
-						"-e", cell.Rvarcall_joberr,
-						"-R'select[mem>5000] rusage[mem=5000]'", "-M5000",
-						"-n", "1",
-						Rscript_exec, "callVars.R",
-						cell.Splitbam_bamout,
-						cell.Rvarcall_dir_out).CombinedOutput()
-
-					if err != nil {
-						// Display everything we got if error.
-						log.Println("Error when running command.  Output:")
-						log.Println(string(output))
-						log.Printf("Got command status: %s\n", err.Error())
-						return
-					}
-
-					// set expected output merged rds filenames to barcode object
-					barcode_trimmed := strings.ReplaceAll(cell.Name, "-1", "")
-					cell.Rvarcall_call_out = cell.Rvarcall_dir_out + "cell_" + barcode_trimmed + ".calls.rds"
-					cell.Rvarcall_cov_out = cell.Rvarcall_dir_out + "cell_" + barcode_trimmed + ".coverage.rds"
-
-				}
-			}
-
-			// wait for variant calls to finish
-			bjobsIsCompleted(chunk_cell_map, "Rvarcall_command_successful", &barcode_list, []string{"Rvarcall_jobout", "Rvarcall_joberr", "Splitbam_bamout", "Splitbam_bamindex"})
-
-			// merge completed rds together into one rds for whole chunk
-			output, err := exec.Command(
-				"bsub",
-				"-I",
-				"-R'select[mem>16000] rusage[mem=16000]'", "-M16000",
-				Rscript_exec, "mergeVarcallRds.R",
-				chunk_output, strconv.Itoa(chunk_i)).CombinedOutput()
-
-			if err != nil {
-				// Display everything we got if error.
-				log.Println("Error when running command.  Output:")
-				log.Println(string(output))
-				log.Printf("Got command status: %s\n", err.Error())
-				return
-			}
-
-			for i := range chunk {
-				cell := &chunk[i]
-				if cell.Rvarcall_command_successful {
-
-					cell.Rdsmerge_rds_coverage = chunk_output + "chunk_" + strconv.Itoa(chunk_i) + ".coverage.rds"
-					cell.Rdsmerge_rds_calls = chunk_output + "chunk_" + strconv.Itoa(chunk_i) + ".calls.rds"
-
-					cell.Rdsmerge_success = true
-
-					if fileExists(cell.Rdsmerge_rds_coverage) {
-						rmIfExists(cell.Rvarcall_cov_out)
-					}
-
-					if fileExists(cell.Rdsmerge_rds_calls) {
-						rmIfExists(cell.Rvarcall_call_out)
-					}
-				}
-
-			}
-		}
-		writeCheckpoint(barcode_list, current_step)
+	handleInterrupts()
 
+	if !runSteps() {
+		os.Exit(1)
 	}
 
 	//current_step = 8
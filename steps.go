@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// pipelineStep is one of the checkpointed steps main goes through in order.
+// run does the work of the step on barcode_list, plan describes what it would
+// do without submitting or creating anything, for --dry-run.
+type pipelineStep struct {
+	Description string
+	run         func() error
+	plan        func(step *plannedStep)
+}
+
+var pipeline_steps = []pipelineStep{
+	{"Define input and output paths for master bam", defineMaster, planDefineMaster},
+	{"Subset bam file to MT only", subsetMT, planSubsetMT},
+	{"Index MT subset bam", indexMT, planIndexMT},
+	{"Subset to QC passed barcodes", subsetQC, planSubsetQC},
+	{"Deduplicate UMIs", dedupUMIs, planDedupUMIs},
+	{"Index deduped bam", indexDeduped, planIndexDeduped},
+	{"Read barcodes in deduped bam", listBarcodes, planListBarcodes},
+	{"Call variants of every cell", callCellVariants, planCallCellVariants},
+	{"Select informative variants across cells", selectVariants, planSelectVariants},
+	{"Estimate the heteroplasmy of every call", estimateHeteroplasmy, planEstimateHeteroplasmy},
+}
+
+var input_bam string
+var barcodes_qc string
+var umitools_exec string
+
+// paths of the files produced on the master bam
+func mtSubsetPath() string     { return output_dir + "/MT_subset.bam" }
+func qcSubsetPath() string     { return output_dir + "/MT_subset_QC_filtered.bam" }
+func dedupedPath() string      { return output_dir + "/MT_subset_umi_deduped.bam" }
+func barcodeStatsPath() string { return output_dir + "/barcode_stats.tsv.gz" }
+
+func chunkOutput(chunk_i int) string {
+	return output_dir + "/chunk_" + strconv.Itoa(chunk_i) + "/"
+}
+
+func checkpointPath(step int) string {
+	return output_dir + fmt.Sprintf("checkpoint_%d.json", step)
+}
+
+// loadCheckpoint loads barcode_list from the checkpoint of a step, returning
+// false if the step hasn't been completed yet
+func loadCheckpoint(step int) bool {
+	if !fileExists(checkpointPath(step)) {
+		return false
+	}
+
+	jsonFile, err := os.Open(checkpointPath(step))
+	if err != nil {
+		panic(err)
+	}
+	defer jsonFile.Close()
+	byteValue, _ := ioutil.ReadAll(jsonFile)
+	err = json.Unmarshal([]byte(byteValue), &barcode_list)
+	if err != nil {
+		panic(err)
+	}
+
+	log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", step))
+	return true
+}
+
+// quickcheckJob checks a bam, or a CRAM input which can only be read by samtools
+func quickcheckJob(bam_filename string) job {
+	if useNativeBam() && !isCram(bam_filename) {
+		return nativeQuickcheckJob(bam_filename)
+	}
+	return withResources("quickcheck", job{
+		Name:    "quickcheck_" + filepath.Base(bam_filename),
+		Command: []string{samtools_exec, "quickcheck", bam_filename},
+		Stdout:  bam_filename + ".quickcheck.o",
+		Stderr:  bam_filename + ".quickcheck.e",
+	})
+}
+
+func indexJob(bam_filename string) job {
+	if useNativeBam() {
+		return nativeIndexJob(bam_filename)
+	}
+	return withResources("index", job{
+		Name:    "index_" + filepath.Base(bam_filename),
+		Command: []string{samtools_exec, "index", bam_filename},
+		Stdout:  bam_filename + ".index.o",
+		Stderr:  bam_filename + ".index.e",
+	})
+}
+
+// mtSubsetJob writes the MT reads of the input to a bam, a CRAM input being
+// decoded by samtools with reference_fasta
+func mtSubsetJob(input string, mt_subset_bam string) job {
+	if useNativeBam() && !isCram(input) {
+		return nativeMTSubsetJob(input, mt_subset_bam)
+	}
+
+	view_command := []string{samtools_exec, "view", input, mt_contig.Name, "-b", "-@", strconv.Itoa(stepCores("mt_subset"))}
+	if isCram(input) {
+		view_command = append(view_command, "-T", viper.GetString("reference_fasta"))
+	}
+	return withResources("mt_subset", job{
+		Name:     "MT_subset",
+		Stdout:   output_dir + "MT_subset.o",
+		Stderr:   output_dir + "MT_subset.e",
+		Pipeline: newPipeline(view_command...).to(mt_subset_bam),
+	})
+}
+
+// qcSubsetJob keeps the reads of the whitelisted barcodes, given to subset-bam
+// in the file written at whitelistPath
+func qcSubsetJob(mt_subset_bam string, qc_subset_bam string, barcodes []string, found *int) job {
+	if useNativeBam() {
+		return nativeQCSubsetJob(mt_subset_bam, qc_subset_bam, barcodes, found)
+	}
+	return withResources("qc_subset", job{
+		Name:   "QC_subset",
+		Stdout: output_dir + "MT_subset_QC_filtered.o",
+		Stderr: output_dir + "MT_subset_QC_filtered.e",
+		Command: []string{
+			"subset-bam", "--cores", strconv.Itoa(stepCores("qc_subset")),
+			"--bam", mt_subset_bam,
+			"--cell-barcodes", whitelistPath(),
+			"--out-bam", qc_subset_bam},
+	})
+}
+
+func umiDedupJob(qc_subset_bam string, deduped_bam string, stats *map[string]dedupStats) job {
+	if useNativeDedup() {
+		return nativeUMIDedupJob(qc_subset_bam, deduped_bam, stats)
+	}
+	return withResources("umi_dedup", job{
+		Name:   "UMI_dedup",
+		Stdout: output_dir + "MT_subset_umi_deduped.o",
+		Stderr: output_dir + "MT_subset_umi_deduped.e",
+		Command: []string{
+			umitools_exec, "dedup",
+			"--paired",
+			"--chrom", mt_contig.Name,
+			"--extract-umi-method", "tag",
+			"--umi-tag", "UB",
+			"--per-cell", "--cell-tag", "CB",
+			"-I", qc_subset_bam,
+			"-S", deduped_bam},
+	})
+}
+
+// rdsMergeJob merges the tables of the cells of a chunk, naming the reference
+// base of every row when reference_fasta is set
+func rdsMergeJob(chunk_output string, chunk_i int) job {
+	command := []string{
+		Rscript_exec, "mergeVarcallRds.R",
+		chunk_output, strconv.Itoa(chunk_i)}
+	if reference_bases := referenceBasesPath(); reference_bases != "" {
+		command = append(command, reference_bases)
+	}
+	return withResources("rds_merge", job{
+		Name:    "rdsmerge_" + strconv.Itoa(chunk_i),
+		Stdout:  chunk_output + "rdsmerge.o",
+		Stderr:  chunk_output + "rdsmerge.e",
+		Command: command,
+	})
+}
+
+// rds_strands are the tables of the counts on each strand written next to
+// every calls and coverage rds
+var rds_strands = []string{"fwd", "rev"}
+
+// strandRdsPath is the table of a strand next to a calls or coverage rds, like
+// chunk_0.calls_fwd.rds for chunk_0.calls.rds
+func strandRdsPath(rds_path string, strand string) string {
+	return strings.TrimSuffix(rds_path, ".rds") + "_" + strand + ".rds"
+}
+
+func chunkRdsPaths(chunk_output string, chunk_i int) (string, string) {
+	return chunk_output + "chunk_" + strconv.Itoa(chunk_i) + ".calls.rds",
+		chunk_output + "chunk_" + strconv.Itoa(chunk_i) + ".coverage.rds"
+}
+
+// step 1
+func defineMaster() error {
+	log.Println("Defining input and output paths for master bam")
+	err := os.Mkdir(output_dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// define a "master" barcode for the bam file that is to be split
+	// this isnt a barcode per se, but the origin of the barcodes
+	var master_barcode barcode
+	master_barcode.Name = "MASTER"
+	master_barcode.Output_dir = output_dir
+	master_barcode.Masterbam_original = input_bam
+	master_barcode.Masterbam_sample = sample_id
+	master_barcode.Masterbam_MT_contig = mt_contig.Name
+	master_barcode.Masterbam_MT_length = mt_contig.Length
+
+	barcode_list = append(barcode_list, master_barcode)
+	return nil
+}
+
+// step 2
+func subsetMT() error {
+	master_barcode := &barcode_list[0]
+
+	log.Println("Quickchecking input bam file")
+
+	master_barcode.Masterbam_original_quickcheck_success = quickcheckBam(master_barcode.Masterbam_original, master_barcode)
+
+	log.Println("Subsetting bam file to MT only")
+
+	err := runJob(mtSubsetJob(master_barcode.Masterbam_original, mtSubsetPath()), master_barcode)
+	if err != nil {
+		return err
+	}
+
+	master_barcode.Masterbam_MT_subset = mtSubsetPath()
+
+	log.Println("Quickchecking subset bam file")
+
+	master_barcode.Masterbam_MT_subset_quickcheck_success = quickcheckBam(master_barcode.Masterbam_MT_subset, master_barcode)
+	return nil
+}
+
+// step 3
+func indexMT() error {
+	log.Println("Indexing newly created MT subset bam")
+
+	(&barcode_list[0]).Masterbam_MT_subset_index_success = indexBam((&barcode_list[0]).Masterbam_MT_subset, &barcode_list[0])
+	return nil
+}
+
+// step 4
+func subsetQC() error {
+	log.Println("Subsetting to QC passed barcodes")
+	(&barcode_list[0]).Masterbam_QC_subset = qcSubsetPath()
+
+	// the barcodes of the list are only given the -1 GEM well suffix when those of the bam have one
+	add_gem_well, err := bamHasGemWells((&barcode_list[0]).Masterbam_MT_subset)
+	if err != nil {
+		return err
+	}
+	barcodes, err := loadWhitelist(barcodes_qc, viper.GetString("barcode_column"), sample_id, add_gem_well)
+	if err != nil {
+		return fmt.Errorf("unable to read the barcodes of %s: %w", barcodes_qc, err)
+	}
+	(&barcode_list[0]).Masterbam_QC_whitelisted = len(barcodes)
+	if !useNativeBam() {
+		err = writeWhitelist(whitelistPath(), barcodes)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = runJob(qcSubsetJob((&barcode_list[0]).Masterbam_MT_subset, (&barcode_list[0]).Masterbam_QC_subset, barcodes, &(&barcode_list[0]).Masterbam_QC_whitelisted_found), &barcode_list[0])
+	if err != nil {
+		return err
+	}
+	if !useNativeBam() {
+		(&barcode_list[0]).Masterbam_QC_whitelisted_found, err = countWhitelistFound((&barcode_list[0]).Masterbam_QC_subset, barcodes)
+		if err != nil {
+			return err
+		}
+	}
+	reportWhitelist(barcodes, (&barcode_list[0]).Masterbam_QC_whitelisted_found)
+
+	(&barcode_list[0]).Masterbam_QC_subset_quickcheck_success = quickcheckBam((&barcode_list[0]).Masterbam_QC_subset, &barcode_list[0])
+
+	(&barcode_list[0]).Masterbam_QC_subset_index_success = indexBam((&barcode_list[0]).Masterbam_QC_subset, &barcode_list[0])
+	return nil
+}
+
+// step 5
+func dedupUMIs() error {
+	log.Println("Deduplicating UMIs")
+	(&barcode_list[0]).Masterbam_UMI_deduped = dedupedPath()
+
+	err := runJob(umiDedupJob((&barcode_list[0]).Masterbam_QC_subset, (&barcode_list[0]).Masterbam_UMI_deduped, &(&barcode_list[0]).Masterbam_UMI_dedup_stats), &barcode_list[0])
+	if err != nil {
+		return err
+	}
+
+	(&barcode_list[0]).Masterbam_UMI_deduped_success = true
+
+	// quickcheck produced bam
+	(&barcode_list[0]).Masterbam_UMI_deduped_quickcheck_success = quickcheckBam((&barcode_list[0]).Masterbam_UMI_deduped, &barcode_list[0])
+	return nil
+}
+
+// step 6
+func indexDeduped() error {
+	log.Println("Indexing newly created deduped bam")
+
+	(&barcode_list[0]).Masterbam_UMI_deduped_index_success = indexBam((&barcode_list[0]).Masterbam_UMI_deduped, &barcode_list[0])
+	return nil
+}
+
+// step 7
+func listBarcodes() error {
+	log.Println("Reading barcodes in deduped and subset bam input")
+	return runJob(barcodeStatsJob((&barcode_list[0]).Masterbam_UMI_deduped), &barcode_list[0])
+}
+
+// step 8, cells are already in barcode_list when resuming from a partial checkpoint
+func callCellVariants() error {
+	if len(barcode_list) == 1 {
+		cells, err := readBarcodeStats(barcodeStatsPath())
+		if err != nil {
+			return err
+		}
+		barcode_list = append(barcode_list, cells...)
+	}
+
+	(&barcode_list[0]).Masterbam_read_filters = &read_filters
+	err := writeVarcallMetadata(read_filters)
+	if err != nil {
+		return err
+	}
+
+	if useNativeVarcall() {
+		return pileupCellVariants()
+	}
+
+	err = writeReferenceBases()
+	if err != nil {
+		return err
+	}
+
+	// chunk the list of barcodes into groups of 500
+	chunked_barcode_list := chunkSlice(barcode_list[1:], 500)
+
+	log.Println("Spliting and calling variants on chunks of 500 barcodes")
+	for chunk_i, chunk := range chunked_barcode_list {
+		if chunkMerged(chunk) {
+			log.Println(fmt.Sprintf("Chunk %d was completed by a previous run", chunk_i))
+			continue
+		}
+
+		chunk_output := chunkOutput(chunk_i)
+		err := os.MkdirAll(chunk_output, 0755)
+		if err != nil {
+			return err
+		}
+
+		if array_exec, use_arrays := useJobArrays(); use_arrays {
+			err = submitChunkArray(chunk, chunk_output, chunk_i, array_exec)
+		} else {
+			err = submitChunkJobs(chunk, chunk_output)
+		}
+		if err != nil {
+			return err
+		}
+
+		// merge completed rds together into one rds for whole chunk
+		err = runJob(rdsMergeJob(chunk_output, chunk_i), &barcode_list[0])
+		if err != nil {
+			return err
+		}
+
+		chunk_calls, chunk_coverage := chunkRdsPaths(chunk_output, chunk_i)
+		for i := range chunk {
+			cell := &chunk[i]
+			if cell.Rvarcall_command_successful {
+
+				cell.Rdsmerge_rds_coverage = chunk_coverage
+				cell.Rdsmerge_rds_calls = chunk_calls
+
+				cell.Rdsmerge_success = true
+
+				if fileExists(cell.Rdsmerge_rds_coverage) {
+					rmIfExists(cell.Rvarcall_cov_out)
+					for _, strand := range rds_strands {
+						rmIfExists(strandRdsPath(cell.Rvarcall_cov_out, strand))
+					}
+				}
+
+				if fileExists(cell.Rdsmerge_rds_calls) {
+					rmIfExists(cell.Rvarcall_call_out)
+					for _, strand := range rds_strands {
+						rmIfExists(strandRdsPath(cell.Rvarcall_call_out, strand))
+					}
+				}
+			}
+
+		}
+	}
+	return nil
+}
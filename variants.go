@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// variantSelection is what a variant must show across cells for
+// selectVariants.R to keep it as informative, for lineage tracing
+type variantSelection struct {
+	min_coverage           int     // reads of a cell at the position for its allele frequency to be used
+	min_heteroplasmy       float64 // allele frequency of a cell carrying the variant
+	min_cells              int     // cells carrying the variant
+	min_vmr                float64 // variance-mean ratio of the allele frequencies across cells
+	max_mean_af            float64 // above it the variant is in nearly every cell, telling none apart
+	min_strand_correlation float64 // of the forward and reverse counts across cells
+}
+
+// variantSelectionFromConfig gives the selection of informative variants, or
+// nil when it isn't run
+func variantSelectionFromConfig() *variantSelection {
+	if !viper.GetBool("variant_selection.enabled") {
+		return nil
+	}
+	return &variantSelection{
+		min_coverage:           viper.GetInt("variant_selection.min_coverage"),
+		min_heteroplasmy:       viper.GetFloat64("variant_selection.min_heteroplasmy"),
+		min_cells:              viper.GetInt("variant_selection.min_cells"),
+		min_vmr:                viper.GetFloat64("variant_selection.min_vmr"),
+		max_mean_af:            viper.GetFloat64("variant_selection.max_mean_af"),
+		min_strand_correlation: viper.GetFloat64("variant_selection.min_strand_correlation"),
+	}
+}
+
+func (selection *variantSelection) valid() bool {
+	return selection.min_coverage >= 1 && selection.min_cells >= 1 && selection.min_vmr >= 0 &&
+		selection.min_heteroplasmy > 0 && selection.min_heteroplasmy <= 1 &&
+		selection.max_mean_af > 0 && selection.max_mean_af <= 1 &&
+		selection.min_strand_correlation >= -1 && selection.min_strand_correlation <= 1
+}
+
+// paths of the selection of the variants of the cells of a directory: the
+// ranked table of every variant and the tables of the informative ones
+func variantSelectionOutput(dir string) string { return dir + "variant_selection/" }
+
+func rankedVariantsPath(dir string) string { return variantSelectionOutput(dir) + "variants.tsv" }
+
+func informativeRdsPaths(dir string) (string, string, string) {
+	selection_dir := variantSelectionOutput(dir)
+	return selection_dir + "informative.calls.rds", selection_dir + "informative.coverage.rds", selection_dir + "informative.af.rds"
+}
+
+// cellRdsPaths are the calls and coverage tables the merged cells are in, once each
+func cellRdsPaths(cells []barcode) ([]string, []string) {
+	var calls, coverage []string
+	seen := make(map[string]bool)
+	for _, cell := range cells {
+		if !cell.Rdsmerge_success || seen[cell.Rdsmerge_rds_calls] {
+			continue
+		}
+		seen[cell.Rdsmerge_rds_calls] = true
+		calls = append(calls, cell.Rdsmerge_rds_calls)
+		coverage = append(coverage, cell.Rdsmerge_rds_coverage)
+	}
+	return calls, coverage
+}
+
+func variantSelectionJob(calls []string, coverage []string, dir string, selection *variantSelection) job {
+	selection_dir := variantSelectionOutput(dir)
+	return withResources("variant_selection", job{
+		Name:   "variant_selection",
+		Stdout: selection_dir + "variant_selection.o",
+		Stderr: selection_dir + "variant_selection.e",
+		Command: []string{
+			Rscript_exec, "selectVariants.R",
+			strings.Join(calls, ","), strings.Join(coverage, ","), selection_dir,
+			strconv.Itoa(selection.min_coverage),
+			strconv.FormatFloat(selection.min_heteroplasmy, 'g', -1, 64),
+			strconv.Itoa(selection.min_cells),
+			strconv.FormatFloat(selection.min_vmr, 'g', -1, 64),
+			strconv.FormatFloat(selection.max_mean_af, 'g', -1, 64),
+			strconv.FormatFloat(selection.min_strand_correlation, 'g', -1, 64)},
+	})
+}
+
+// countInformative reads how many of the ranked variants were kept as informative
+func countInformative(ranked_path string) (int, int, error) {
+	file, err := os.Open(ranked_path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	table, err := newTableReader(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	header, err := table.Read()
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", ranked_path, err)
+	}
+	informative_column := -1
+	for i, column := range header {
+		if column == "Informative" {
+			informative_column = i
+		}
+	}
+	if informative_column < 0 {
+		return 0, 0, fmt.Errorf("%s has no Informative column", ranked_path)
+	}
+
+	variants, informative := 0, 0
+	for {
+		row, err := table.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", ranked_path, err)
+		}
+		variants++
+		if row[informative_column] == "TRUE" {
+			informative++
+		}
+	}
+	return variants, informative, nil
+}
+
+// selectCellVariants runs the selection on the calls of the cells into dir,
+// recording its outputs on owner
+func selectCellVariants(cells []barcode, dir string, owner *barcode) error {
+	selection := variantSelectionFromConfig()
+	if selection == nil {
+		log.Println("Variant selection is disabled, skipping it")
+		return nil
+	}
+	calls, coverage := cellRdsPaths(cells)
+	if len(calls) == 0 {
+		log.Println("No cell has calls to select variants from")
+		return nil
+	}
+
+	err := os.MkdirAll(variantSelectionOutput(dir), 0755)
+	if err != nil {
+		return err
+	}
+	err = runJob(variantSelectionJob(calls, coverage, dir, selection), owner)
+	if err != nil {
+		return err
+	}
+
+	variants, informative, err := countInformative(rankedVariantsPath(dir))
+	if err != nil {
+		return err
+	}
+	log.Println(fmt.Sprintf("Kept %d of %d variants as informative", informative, variants))
+	owner.Variants_ranked = rankedVariantsPath(dir)
+	owner.Variants_informative = informative
+	return nil
+}
+
+// step 9
+func selectVariants() error {
+	return selectCellVariants(barcode_list[1:], output_dir, &barcode_list[0])
+}
+
+func planSelectVariants(step *plannedStep) {
+	selection := variantSelectionFromConfig()
+	if selection == nil {
+		step.Notes = append(step.Notes, "variant_selection is disabled, nothing is run")
+		return
+	}
+	calls, coverage := plannedCellRdsPaths(step)
+	planVariantSelection(step, calls, coverage, output_dir, selection)
+}
+
+// plannedCellRdsPaths are the tables step 8 writes: those of the pileup, or
+// those of every chunk of cells with callVars.R
+func plannedCellRdsPaths(step *plannedStep) ([]string, []string) {
+	if useNativeVarcall() {
+		rds_calls, rds_coverage := pileupRdsPaths()
+		return []string{rds_calls}, []string{rds_coverage}
+	}
+
+	cells, err := readBarcodeStats(barcodeStatsPath())
+	if err != nil {
+		step.Notes = append(step.Notes, "cell barcodes are only known once step 7 has run, the tables of a single chunk are shown")
+		cells = []barcode{{Name: "<barcode>"}}
+	}
+	var calls, coverage []string
+	for chunk_i := range chunkSlice(cells, 500) {
+		chunk_calls, chunk_coverage := chunkRdsPaths(chunkOutput(chunk_i), chunk_i)
+		calls = append(calls, chunk_calls)
+		coverage = append(coverage, chunk_coverage)
+	}
+	return calls, coverage
+}
+
+func planVariantSelection(step *plannedStep, calls []string, coverage []string, dir string, selection *variantSelection) {
+	informative_calls, informative_coverage, informative_af := informativeRdsPaths(dir)
+	step.Created = append(step.Created, variantSelectionOutput(dir))
+	step.Jobs = append(step.Jobs,
+		planJob(variantSelectionJob(calls, coverage, dir, selection), append(append([]string{}, calls...), coverage...),
+			[]string{rankedVariantsPath(dir), informative_calls, informative_coverage, informative_af}),
+	)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"scVarCall/bam"
+)
+
+// splitSamplePrefix splits the sample ArchR puts in front of barcodes followed
+// by #, or scVarCall followed by : in multi-sample runs, from the barcode
+func splitSamplePrefix(name string) (string, string) {
+	name = strings.TrimSpace(name)
+	if separator := strings.LastIndexAny(name, "#:"); separator >= 0 {
+		return name[:separator], name[separator+1:]
+	}
+	return "", name
+}
+
+// normaliseBarcode gives the barcode as found in the CB tags of the bam, from
+// the forms it takes in cell lists: with the sample in front of it, or without
+// the -1 suffix of the first GEM well when the CB tags have one
+func normaliseBarcode(name string, add_gem_well bool) string {
+	_, name = splitSamplePrefix(name)
+	if _, gem_well, err := parseBarcode(name); err == nil && gem_well == "" && add_gem_well {
+		name += "-1"
+	}
+	return name
+}
+
+// gem_well_sample is the number of CB tags looked at to tell whether the
+// barcodes of a bam have a GEM well suffix
+const gem_well_sample = 1000
+
+// bamHasGemWells tells whether the CB tags of the first reads of a bam have a
+// GEM well suffix, as those of CellRanger 2 and later do. A bam without CB
+// tags is taken to have them.
+func bamHasGemWells(bam_path string) (bool, error) {
+	file, err := os.Open(bam_path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	reader, err := bam.NewReader(bufio.NewReaderSize(file, 1<<20))
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", bam_path, err)
+	}
+	seen := 0
+	for seen < gem_well_sample {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", bam_path, err)
+		}
+		cell_barcode, has_cell := rec.TagString("CB")
+		if !has_cell {
+			continue
+		}
+		seen++
+		if _, gem_well, err := parseBarcode(cell_barcode); err == nil && gem_well != "" {
+			return true, nil
+		}
+	}
+	return seen == 0, nil
+}
+
+// looksLikeBarcode tells a header line from the first barcode
+func looksLikeBarcode(barcode_str string) bool {
+	_, _, err := parseBarcode(barcode_str)
+	return err == nil
+}
+
+// newTableReader reads a TSV or a CSV, gzipped or not, telling them apart
+// from the tabs or commas of the first line
+func newTableReader(file io.Reader) (*csv.Reader, error) {
+	var input io.Reader = bufio.NewReader(file)
+	if magic, err := input.(*bufio.Reader).Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(input)
+		if err != nil {
+			return nil, err
+		}
+		input = gr
+	}
+
+	lines := bufio.NewReader(input)
+	first_line, err := lines.Peek(4096)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	delimiter := '\t'
+	if first := strings.SplitN(string(first_line), "\n", 2)[0]; !strings.Contains(first, "\t") && strings.Contains(first, ",") {
+		delimiter = ','
+	}
+
+	table := csv.NewReader(lines)
+	table.Comma = delimiter
+	table.FieldsPerRecord = -1
+	table.LazyQuotes = true
+	return table, nil
+}
+
+// loadWhitelist reads the barcodes of a cell list, which can be a plain list, a
+// TSV or a CSV, gzipped or not, like CellRanger's barcodes.tsv.gz, a Seurat
+// metadata CSV or an ArchR cell list. The barcodes are taken from the column
+// given by its 1-based number or by its name in the header line. In a
+// multi-sample run, barcodes prefixed by another sample than sample_id are
+// left out. Barcodes without a GEM well suffix are given the -1 of the first
+// one when add_gem_well is set, for bams whose CB tags have one.
+func loadWhitelist(path string, column string, sample_id string, add_gem_well bool) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	table, err := newTableReader(file)
+	if err != nil {
+		return nil, err
+	}
+	delimiter := table.Comma
+
+	column_i, by_number := -1, false
+	if number, err := strconv.Atoi(column); err == nil {
+		if number < 1 {
+			return nil, fmt.Errorf("barcode column %d should be 1 or more", number)
+		}
+		column_i, by_number = number-1, true
+	}
+
+	var barcodes []string
+	seen := make(map[string]bool)
+	header := true
+	for {
+		row, err := table.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		if header {
+			header = false
+			if !by_number {
+				for i, name := range row {
+					if strings.TrimSpace(name) == column {
+						column_i = i
+					}
+				}
+				if column_i < 0 {
+					return nil, fmt.Errorf("no column %s in the header of %s", column, path)
+				}
+				continue
+			}
+			// a header line is skipped when the column doesn't hold a barcode
+			if column_i < len(row) && !looksLikeBarcode(normaliseBarcode(row[column_i], add_gem_well)) {
+				continue
+			}
+		}
+
+		if column_i >= len(row) {
+			return nil, fmt.Errorf("line of %s has no column %s: %s", path, column, strings.Join(row, string(delimiter)))
+		}
+		// in a list shared by the samples of a run, only the barcodes of the sample are kept
+		if prefix, _ := splitSamplePrefix(row[column_i]); sample_id != "" && prefix != "" && prefix != sample_id {
+			continue
+		}
+		barcode_str := normaliseBarcode(row[column_i], add_gem_well)
+		if _, _, err := parseBarcode(barcode_str); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if !seen[barcode_str] {
+			seen[barcode_str] = true
+			barcodes = append(barcodes, barcode_str)
+		}
+	}
+	if len(barcodes) == 0 {
+		return nil, fmt.Errorf("no barcodes in %s", path)
+	}
+	return barcodes, nil
+}
+
+// whitelistPath is the list of normalised barcodes given to subset-bam
+func whitelistPath() string { return output_dir + "/barcode_whitelist.txt" }
+
+func writeWhitelist(path string, barcodes []string) error {
+	return os.WriteFile(path, []byte(strings.Join(barcodes, "\n")+"\n"), 0644)
+}
+
+// countWhitelistFound counts the whitelisted barcodes with reads in a bam
+func countWhitelistFound(bam_path string, barcodes []string) (int, error) {
+	whitelisted := make(map[string]bool, len(barcodes))
+	for _, barcode_str := range barcodes {
+		whitelisted[barcode_str] = true
+	}
+
+	file, err := os.Open(bam_path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader, err := bam.NewReader(bufio.NewReaderSize(file, 1<<20))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", bam_path, err)
+	}
+	found := make(map[string]bool)
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", bam_path, err)
+		}
+		if cell_barcode, has_cell := rec.TagString("CB"); has_cell && whitelisted[cell_barcode] {
+			found[cell_barcode] = true
+		}
+	}
+	return len(found), nil
+}
+
+// nativeQCSubsetJob keeps the reads of the whitelisted barcodes in process,
+// the number of whitelisted barcodes with reads being put in found
+func nativeQCSubsetJob(mt_subset_bam string, qc_subset_bam string, barcodes []string, found *int) job {
+	return job{
+		Name: "QC_subset",
+		Native: &nativeTask{
+			Description: fmt.Sprintf("write the reads of %s with a CB in %s to %s", mt_subset_bam, barcodes_qc, qc_subset_bam),
+			run: func() error {
+				whitelisted := make(map[string]bool, len(barcodes))
+				for _, barcode_str := range barcodes {
+					whitelisted[barcode_str] = true
+				}
+				found_barcodes := make(map[string]bool)
+				reads, err := bam.FilterFile(mt_subset_bam, qc_subset_bam, func(rec *bam.Record) bool {
+					cell_barcode, has_cell := rec.TagString("CB")
+					if !has_cell || !whitelisted[cell_barcode] {
+						return false
+					}
+					found_barcodes[cell_barcode] = true
+					return true
+				})
+				if err != nil {
+					return err
+				}
+				*found = len(found_barcodes)
+				log.Println(fmt.Sprintf("Kept %d reads of whitelisted barcodes in %s", reads, qc_subset_bam))
+				return nil
+			},
+		},
+	}
+}
+
+// reportWhitelist logs how many of the whitelisted barcodes were in the bam,
+// and some of the ones that weren't when none were found
+func reportWhitelist(barcodes []string, found int) {
+	log.Println(fmt.Sprintf("Found %d of the %d whitelisted barcodes of %s in the bam", found, len(barcodes), barcodes_qc))
+	if found == 0 {
+		examples := append([]string(nil), barcodes...)
+		sort.Strings(examples)
+		if len(examples) > 3 {
+			examples = examples[:3]
+		}
+		log.Println(fmt.Sprintf("None of the whitelisted barcodes, like %s, have reads, check barcode_column is the column of the barcodes", strings.Join(examples, ", ")))
+	}
+}
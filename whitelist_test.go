@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeCellList writes a cell list to a temporary directory, gzipping it when
+// its name ends in .gz
+func writeCellList(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	data := []byte(content)
+	if strings.HasSuffix(name, ".gz") {
+		var gzipped bytes.Buffer
+		gw := gzip.NewWriter(&gzipped)
+		if _, err := gw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data = gzipped.Bytes()
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadWhitelist(t *testing.T) {
+	useDefaultBarcodePattern(t)
+
+	tests := []struct {
+		description string
+		name        string
+		content     string
+		column      string
+		sample_id   string
+		expected    []string
+	}{
+		{
+			"CellRanger barcodes.tsv.gz", "barcodes.tsv.gz",
+			"AAACCTGA-1\nAAACGGGT-1\nAAACCTGA-1\n", "1", "",
+			[]string{"AAACCTGA-1", "AAACGGGT-1"},
+		},
+		{
+			"TSV with a header and the barcodes in the second column", "cells.tsv",
+			"cluster\tbarcode\n1\tAAACCTGA\n2\tAAACGGGT-2\n", "2", "",
+			[]string{"AAACCTGA-1", "AAACGGGT-2"},
+		},
+		{
+			"Seurat metadata CSV", "metadata.csv",
+			"\"\",\"orig.ident\",\"nCount_RNA\"\n\"AAACCTGA-1\",\"sample1\",1200\n\"AAACGGGT-1\",\"sample1\",800\n", "1", "",
+			[]string{"AAACCTGA-1", "AAACGGGT-1"},
+		},
+		{
+			"column given by name in a gzipped CSV", "cells.csv.gz",
+			"nFrags,cellNames,TSSEnrichment\n3000,AAACCTGA-1,12\n2500,AAACGGGT-1,9\n", "cellNames", "",
+			[]string{"AAACCTGA-1", "AAACGGGT-1"},
+		},
+		{
+			"ArchR cell list with sample prefixes", "archr.tsv",
+			"cellNames\nsample1#AAACCTGA-1\nsample1#AAACGGGT\n", "cellNames", "",
+			[]string{"AAACCTGA-1", "AAACGGGT-1"},
+		},
+		{
+			"ArchR cell list shared by the samples of a run", "archr.tsv",
+			"cellNames\nsample1#AAACCTGA-1\nsample2#AAACGGGT-1\nsample1#TTTCGGGT-1\n", "cellNames", "sample1",
+			[]string{"AAACCTGA-1", "TTTCGGGT-1"},
+		},
+	}
+
+	for _, test := range tests {
+		path := writeCellList(t, test.name, test.content)
+		barcodes, err := loadWhitelist(path, test.column, test.sample_id, true)
+		if err != nil {
+			t.Errorf("%s: %s", test.description, err)
+			continue
+		}
+		if !reflect.DeepEqual(barcodes, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.description, barcodes, test.expected)
+		}
+	}
+}
+
+func TestLoadWhitelistWithoutGemWells(t *testing.T) {
+	useDefaultBarcodePattern(t)
+
+	path := writeCellList(t, "barcodes.tsv", "sample1#AAACCTGA\nAAACGGGT\nAAACTTTT-2\n")
+	barcodes, err := loadWhitelist(path, "1", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"AAACCTGA", "AAACGGGT", "AAACTTTT-2"}; !reflect.DeepEqual(barcodes, expected) {
+		t.Errorf("got %v, expected the barcodes left without a suffix %v", barcodes, expected)
+	}
+}
+
+func TestLoadWhitelistErrors(t *testing.T) {
+	useDefaultBarcodePattern(t)
+
+	for description, test := range map[string]struct {
+		content string
+		column  string
+	}{
+		"unknown column name":  {"barcode\nAAACCTGA-1\n", "cellNames"},
+		"column out of a line": {"AAACCTGA-1\tx\nAAACGGGT-1\n", "2"},
+		"invalid barcode":      {"AAACCTGA-1\nnot a barcode\n", "1"},
+		"no barcodes":          {"barcode\n", "1"},
+		"column 0":             {"AAACCTGA-1\n", "0"},
+	} {
+		path := writeCellList(t, "cells.tsv", test.content)
+		if _, err := loadWhitelist(path, test.column, "", true); err == nil {
+			t.Errorf("%s: expected an error", description)
+		}
+	}
+}
+
+func TestBamHasGemWells(t *testing.T) {
+	useDefaultBarcodePattern(t)
+
+	for _, test := range []struct {
+		cells    []string
+		expected bool
+	}{
+		{[]string{"AAACCTGA-1", "AAACGGGT-1"}, true},
+		{[]string{"AAACCTGA", "AAACGGGT"}, false},
+		{[]string{"", "AAACGGGT-2"}, true},
+		{[]string{""}, true},
+	} {
+		var reads []testRead
+		for i, cell := range test.cells {
+			reads = append(reads, testRead{cell: cell, pos: i, cigar: "4M", seq: "ACGT"})
+		}
+		path := filepath.Join(t.TempDir(), "cells.bam")
+		writeMTBam(t, path, 100, reads)
+
+		has_gem_wells, err := bamHasGemWells(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has_gem_wells != test.expected {
+			t.Errorf("CB tags %v gave %v, expected %v", test.cells, has_gem_wells, test.expected)
+		}
+	}
+}